@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	visibilityPublic   = "public"
+	visibilityUnlisted = "unlisted"
+	visibilityPrivate  = "private"
+)
+
+var (
+	errUnauthorized = errors.New("a valid token is required")
+	errForbidden    = errors.New("access denied")
+)
+
+// Token is one entry of the token file, e.g.
+// [{"token": "...", "user": "alice"}]
+type Token struct {
+	Token string `json:"token"`
+	User  string `json:"user"`
+}
+
+// authenticator maps API tokens to users. Without a token file it is
+// disabled: uploads are anonymous and every recording is readable by id.
+type authenticator struct {
+	users map[string]string
+}
+
+func newAuthenticator(tokensPath string) (error, *authenticator) {
+	a := &authenticator{}
+	if tokensPath == "" {
+		return nil, a
+	}
+
+	tokensJSON, err := ioutil.ReadFile(tokensPath)
+	if err != nil {
+		return err, nil
+	}
+	var tokens []Token
+	err = json.Unmarshal(tokensJSON, &tokens)
+	if err != nil {
+		return err, nil
+	}
+
+	a.users = map[string]string{}
+	for _, token := range tokens {
+		if token.Token == "" || token.User == "" {
+			return errors.New("token file entries need a token and a user"), nil
+		}
+		a.users[token.Token] = token.User
+	}
+	return nil, a
+}
+
+func (a *authenticator) enabled() bool {
+	return a.users != nil
+}
+
+// user returns the user of the bearer token, or of the token query for
+// EventSource clients that cannot set headers. It is empty when the
+// request carries no valid token.
+func (a *authenticator) user(r *http.Request) string {
+	if !a.enabled() {
+		return ""
+	}
+	token := r.URL.Query().Get("token")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return a.users[token]
+}
+
+// requireUser returns the user allowed to create recordings.
+func (a *authenticator) requireUser(r *http.Request) (error, string) {
+	if !a.enabled() {
+		return nil, ""
+	}
+	user := a.user(r)
+	if user == "" {
+		return errUnauthorized, ""
+	}
+	return nil, user
+}
+
+func validVisibility(visibility string, owner string) error {
+	switch visibility {
+	case visibilityPublic, visibilityUnlisted:
+		return nil
+	case visibilityPrivate:
+		if owner == "" {
+			return errors.New("private recordings need an owner, upload with a token")
+		}
+		return nil
+	default:
+		return errors.New("visibility must be 'public', 'unlisted' or 'private'")
+	}
+}
+
+// uploads made before visibility existed stay public
+func (u LiveUpload) visibility() string {
+	if u.Visibility == "" {
+		return visibilityPublic
+	}
+	return u.Visibility
+}
+
+func (u LiveUpload) canView(user string) bool {
+	if u.visibility() != visibilityPrivate {
+		return true
+	}
+	return user != "" && user == u.Owner
+}
+
+// listedTo tells whether the recording shows up in the user's listing.
+func (u LiveUpload) listedTo(user string) bool {
+	if u.visibility() == visibilityPublic {
+		return true
+	}
+	return user != "" && user == u.Owner
+}
+
+func errorStatus(err error) int {
+	if _, ok := err.(tooLargeError); ok {
+		return http.StatusRequestEntityTooLarge
+	}
+	switch err {
+	case errUnauthorized:
+		return http.StatusUnauthorized
+	case errForbidden:
+		return http.StatusForbidden
+	case errDuplicate:
+		return http.StatusConflict
+	case errNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
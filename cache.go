@@ -0,0 +1,165 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"liveCoding-api/util"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// snapshotCacheVersion must be bumped whenever FileInfo or the way it is
+// computed from the code changes, so stale snapshots are not served.
+const snapshotCacheVersion = "7"
+
+// snapshotCacheKey also changes with the configured languages, which
+// decide the detected languages and annotations of a snapshot.
+func snapshotCacheKey() string {
+	return snapshotCacheVersion + "-" + util.Languages.Fingerprint()
+}
+
+// Snapshots are keyed by commit hash, so a new or rewritten commit never
+// hits an old entry. They are kept gzip-compressed next to the hosted repo.
+func snapshotCacheDir(hostedProjectPath string) string {
+	return hostedProjectPath + ".snapshots"
+}
+
+// snapshotMu keeps a snapshot from being written next to a recording
+// while its cache is removed: writers hold it for reading, removeSnapshots
+// for writing.
+var snapshotMu sync.RWMutex
+
+var errRecordingDeleted = errors.New("recording was deleted")
+
+func snapshotCachePath(hostedProjectPath string, hash string) string {
+	return filepath.Join(snapshotCacheDir(hostedProjectPath), snapshotCacheKey(), hash+".json.gz")
+}
+
+func loadSnapshot(cachePath string) (error, map[string]FileInfo) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return err, nil
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err, nil
+	}
+	defer zr.Close()
+
+	fileInfo := map[string]FileInfo{}
+	err = json.NewDecoder(zr).Decode(&fileInfo)
+	if err != nil {
+		return err, nil
+	}
+	return nil, fileInfo
+}
+
+// saveSnapshot writes nothing once the hosted repo is gone, so warming
+// or a viewer racing a delete cannot bring back the cache directory.
+func saveSnapshot(hostedProjectPath string, cachePath string, fileInfo map[string]FileInfo) error {
+	snapshotMu.RLock()
+	defer snapshotMu.RUnlock()
+
+	_, err := os.Stat(hostedProjectPath)
+	if os.IsNotExist(err) {
+		return errRecordingDeleted
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(cachePath), 0775)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file and rename, concurrent viewers may build the
+	// same snapshot at once
+	tempFile, err := ioutil.TempFile(filepath.Dir(cachePath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(tempFile)
+	err = json.NewEncoder(zw).Encode(fileInfo)
+	if closeErr := zw.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := tempFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), cachePath)
+}
+
+// readSnapshot returns the files of the commit from the cache, building
+// and caching them on a miss.
+func readSnapshot(repo *git.Repository, hostedProjectPath string, hash string) (error, map[string]FileInfo) {
+	cachePath := snapshotCachePath(hostedProjectPath, hash)
+
+	err, fileInfo := loadSnapshot(cachePath)
+	if err == nil {
+		return nil, fileInfo
+	}
+
+	err, fileInfo = readCommitFiles(repo, hash)
+	if err != nil {
+		return err, nil
+	}
+
+	err = saveSnapshot(hostedProjectPath, cachePath, fileInfo)
+	if err != nil && err != errRecordingDeleted {
+		// the replay still works, only slower next time
+		log.Printf("error caching snapshot %s: %v", cachePath, err)
+	}
+	return nil, fileInfo
+}
+
+// removeSnapshots removes the cache of a recording whose hosted repo was
+// already moved away, waiting for snapshots being written.
+func removeSnapshots(hostedProjectPath string) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	return os.RemoveAll(snapshotCacheDir(hostedProjectPath))
+}
+
+// warmSnapshots builds the snapshots of freshly stored commits ahead of
+// the first viewer and drops snapshots of older cache versions or
+// languages.
+func warmSnapshots(hostedProjectPath string, commits Commits) {
+	cacheDir := snapshotCacheDir(hostedProjectPath)
+	cacheKey := snapshotCacheKey()
+	versions, err := ioutil.ReadDir(cacheDir)
+	if err == nil {
+		for _, version := range versions {
+			if version.Name() != cacheKey {
+				os.RemoveAll(filepath.Join(cacheDir, version.Name()))
+			}
+		}
+	}
+
+	repo, err := git.PlainOpen(hostedProjectPath)
+	if err != nil {
+		log.Printf("error warming snapshots of %s: %v", hostedProjectPath, err)
+		return
+	}
+
+	for _, commit := range commits {
+		err, _ = readSnapshot(repo, hostedProjectPath, commit.Hash)
+		if err != nil {
+			log.Printf("error warming snapshot %s of %s: %v", commit.Hash, hostedProjectPath, err)
+			return
+		}
+	}
+}
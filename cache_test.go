@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"liveCoding-api/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotCache(t *testing.T) {
+	// not parallel, the languages are shared by all tests
+	store, options := testUploads(t, Config{})
+	params := uploadParams{ProjectName: "demo", Visibility: visibilityPublic}
+	err, liveUpload := createUpload(store, params, uploadFormatTarball, bytes.NewReader(recordingTarball(t, 3)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, commits := store.FindCommits(context.Background(), liveUpload.HostedProjectPath, ReplayQuery{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warmSnapshots(liveUpload.HostedProjectPath, commits)
+	for _, commit := range commits {
+		if _, err := os.Stat(snapshotCachePath(liveUpload.HostedProjectPath, commit.Hash)); err != nil {
+			t.Fatalf("snapshot of %s was not warmed: %v", commit.Hash, err)
+		}
+	}
+
+	oldCacheKey := snapshotCacheKey()
+	oldCacheDir := filepath.Join(snapshotCacheDir(liveUpload.HostedProjectPath), oldCacheKey)
+	// a new id every run, so -count reruns change the languages too
+	util.Languages.Register(util.Language{ID: "cachetest-" + oldCacheKey, Extensions: []string{".cachetest"}, LineComment: "#"})
+	if filepath.Join(snapshotCacheDir(liveUpload.HostedProjectPath), snapshotCacheKey()) == oldCacheDir {
+		t.Fatal("cache key did not change with the languages")
+	}
+	warmSnapshots(liveUpload.HostedProjectPath, commits)
+	if _, err := os.Stat(oldCacheDir); !os.IsNotExist(err) {
+		t.Fatalf("snapshots of the old languages are kept: %v", err)
+	}
+	if _, err := os.Stat(snapshotCachePath(liveUpload.HostedProjectPath, commits[0].Hash)); err != nil {
+		t.Fatalf("snapshot was not warmed again: %v", err)
+	}
+
+	err = deleteRecording(context.Background(), store, newSessionHub(), liveUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// warming that was still running when the recording was deleted
+	cachePath := snapshotCachePath(liveUpload.HostedProjectPath, commits[0].Hash)
+	if err = saveSnapshot(liveUpload.HostedProjectPath, cachePath, map[string]FileInfo{}); err != errRecordingDeleted {
+		t.Fatalf("snapshot of a deleted recording saved: %v", err)
+	}
+	if _, err := os.Stat(snapshotCacheDir(liveUpload.HostedProjectPath)); !os.IsNotExist(err) {
+		t.Fatalf("cache of a deleted recording is back: %v", err)
+	}
+}
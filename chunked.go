@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a chunked upload nobody added a part to for this long is removed
+const chunkedUploadTTL = 24 * time.Hour
+
+const chunkedUploadIDLength = 32
+
+// ChunkedUpload is a recording uploaded in parts. The parts are kept next
+// to it until the client completes the upload.
+type ChunkedUpload struct {
+	ID        string       `json:"id"`
+	Params    uploadParams `json:"params"`
+	CreatedAt int64        `json:"createdAt"`
+}
+
+type ChunkedPart struct {
+	Part int   `json:"part"`
+	Size int64 `json:"size"`
+}
+
+type ChunkedUploadResponse struct {
+	UploadID string        `json:"uploadId"`
+	PartSize int64         `json:"partSize"`
+	Parts    []ChunkedPart `json:"parts"`
+}
+
+type ChunkedUploadsResponse []ChunkedUploadResponse
+
+func chunkedUploadsPath(liveLogDir string) string {
+	return filepath.Join(liveLogDir, ".chunked")
+}
+
+func chunkedUploadPath(liveLogDir string, id string) string {
+	return filepath.Join(chunkedUploadsPath(liveLogDir), id)
+}
+
+func chunkedPartPath(dir string, part int) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%d", part))
+}
+
+func validChunkedUploadID(id string) bool {
+	if len(id) != chunkedUploadIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// findChunkedUpload reads the upload and makes sure the user started it.
+func findChunkedUpload(liveLogDir string, id string, user string) (error, ChunkedUpload) {
+	if !validChunkedUploadID(id) {
+		return errNotFound, ChunkedUpload{}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(chunkedUploadPath(liveLogDir, id), "upload.json"))
+	if os.IsNotExist(err) {
+		return errNotFound, ChunkedUpload{}
+	}
+	if err != nil {
+		return err, ChunkedUpload{}
+	}
+
+	chunkedUpload := ChunkedUpload{}
+	err = json.Unmarshal(data, &chunkedUpload)
+	if err != nil {
+		return err, ChunkedUpload{}
+	}
+	if chunkedUpload.Params.Owner != "" && chunkedUpload.Params.Owner != user {
+		return errForbidden, ChunkedUpload{}
+	}
+	return nil, chunkedUpload
+}
+
+// chunkedParts lists the parts received so far, ordered by number.
+func chunkedParts(dir string) (error, []ChunkedPart) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err, nil
+	}
+
+	parts := []ChunkedPart{}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), "part-") {
+			continue
+		}
+		part, err := strconv.Atoi(strings.TrimPrefix(fi.Name(), "part-"))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, ChunkedPart{Part: part, Size: fi.Size()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Part < parts[j].Part })
+	return nil, parts
+}
+
+// chunkedRoom tells how many bytes part may take before the parts of the
+// upload together go over maxChunkedSize. A part sent again replaces the
+// old one, so that one is not counted.
+func chunkedRoom(dir string, part int, maxChunkedSize int64) (error, int64) {
+	err, parts := chunkedParts(dir)
+	if err != nil {
+		return err, 0
+	}
+	room := maxChunkedSize
+	for _, p := range parts {
+		if p.Part != part {
+			room -= p.Size
+		}
+	}
+	return nil, room
+}
+
+func startChunkedUpload(liveLogDir string, params uploadParams) (error, ChunkedUpload) {
+	err, id := randomText(chunkedUploadIDLength)
+	if err != nil {
+		return err, ChunkedUpload{}
+	}
+	chunkedUpload := ChunkedUpload{ID: id, Params: params, CreatedAt: nowMillis()}
+
+	dir := chunkedUploadPath(liveLogDir, id)
+	err = os.MkdirAll(dir, 0775)
+	if err != nil {
+		return err, ChunkedUpload{}
+	}
+	data, err := json.Marshal(chunkedUpload)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "upload.json"), data, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err, ChunkedUpload{}
+	}
+	return nil, chunkedUpload
+}
+
+// writeChunkedPart stores a part through a rename, so a part sent again
+// after a broken connection simply replaces the first attempt.
+func writeChunkedPart(dir string, part int, body io.Reader) error {
+	tempFile, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempFile, body)
+	if closeErr := tempFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	err = os.Rename(tempFile.Name(), chunkedPartPath(dir, part))
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	// keeps the upload from being swept while parts arrive
+	now := time.Now()
+	return os.Chtimes(dir, now, now)
+}
+
+// completeChunkedUpload joins parts 0 to partCount-1 and creates the
+// recording from them. The parts are claimed by a rename first, so a
+// repeated complete cannot create the recording twice; they are handed
+// back when creating it fails.
+func completeChunkedUpload(store Store, chunkedUpload ChunkedUpload, partCount int, options uploadOptions) (error, LiveUpload) {
+	dir := chunkedUploadPath(options.dir, chunkedUpload.ID)
+	claimedDir := dir + ".complete"
+	err := os.Rename(dir, claimedDir)
+	if os.IsNotExist(err) {
+		return errNotFound, LiveUpload{}
+	}
+	if err != nil {
+		return err, LiveUpload{}
+	}
+	created := false
+	defer func() {
+		if created {
+			os.RemoveAll(claimedDir)
+		} else {
+			os.Rename(claimedDir, dir)
+		}
+	}()
+
+	err, parts := chunkedParts(claimedDir)
+	if err != nil {
+		return err, LiveUpload{}
+	}
+	if len(parts) < partCount {
+		return fmt.Errorf("received %d of %d parts", len(parts), partCount), LiveUpload{}
+	}
+
+	var totalSize int64
+	var readers []io.Reader
+	for i := 0; i < partCount; i++ {
+		if parts[i].Part != i {
+			return fmt.Errorf("part %d is missing", i), LiveUpload{}
+		}
+		totalSize += parts[i].Size
+		if totalSize > options.maxChunkedSize {
+			return tooLargeError(fmt.Sprintf("parts are larger than %d bytes", options.maxChunkedSize)), LiveUpload{}
+		}
+		partFile, err := os.Open(chunkedPartPath(claimedDir, i))
+		if err != nil {
+			return err, LiveUpload{}
+		}
+		defer partFile.Close()
+		readers = append(readers, partFile)
+	}
+
+	err, uploadFormat, body := peekUploadFormat(chunkedUpload.Params.ContentType, io.MultiReader(readers...))
+	if err != nil {
+		return err, LiveUpload{}
+	}
+	err, liveUpload := createUpload(store, chunkedUpload.Params, uploadFormat, body, options)
+	if err != nil {
+		return err, LiveUpload{}
+	}
+	created = true
+	return nil, liveUpload
+}
+
+// sweepChunkedUploads removes chunked uploads that were abandoned.
+func sweepChunkedUploads(liveLogDir string) {
+	fis, err := ioutil.ReadDir(chunkedUploadsPath(liveLogDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error listing chunked uploads: %v", err)
+		}
+		return
+	}
+	for _, fi := range fis {
+		if time.Since(fi.ModTime()) < chunkedUploadTTL {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(chunkedUploadsPath(liveLogDir), fi.Name()))
+		if err != nil {
+			log.Printf("error removing chunked upload %s: %v", fi.Name(), err)
+		}
+	}
+}
+
+// liveChunkedUploadRequest takes a recording in parts for clients on slow
+// or flaky connections:
+//
+//	POST   ?projectName=...         starts an upload, same queries as /api/live/upload
+//	PUT    ?uploadId=...&part=n     stores part n, counted from 0, again on retry
+//	GET    ?uploadId=...            lists the parts received, to resume
+//	POST   ?uploadId=...&parts=n    creates the recording from parts 0 to n-1
+//	DELETE ?uploadId=...            drops the upload
+func liveChunkedUploadRequest(store Store, auth *authenticator, options uploadOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			CORSforOptions(&w)
+			return
+		}
+
+		queryKeys := r.URL.Query()
+		id := queryKeys.Get("uploadId")
+		if r.Method == "POST" && id == "" {
+			err, params := parseUploadParams(r, auth, options)
+			if err == nil && params.GitURL != "" {
+				err = errors.New("a url is cloned, use /api/live/upload")
+			}
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			err, chunkedUpload := startChunkedUpload(options.dir, params)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			responseJSON(w, http.StatusOK, ChunkedUploadsResponse{ChunkedUploadResponse{
+				UploadID: chunkedUpload.ID,
+				PartSize: options.maxSize,
+				Parts:    []ChunkedPart{},
+			}})
+			return
+		}
+
+		if id == "" {
+			responseErrorJSON(w, http.StatusInternalServerError, "url query 'uploadId' is missing")
+			return
+		}
+		err, chunkedUpload := findChunkedUpload(options.dir, id, auth.user(r))
+		if err != nil {
+			responseErrorJSON(w, errorStatus(err), err.Error())
+			return
+		}
+		dir := chunkedUploadPath(options.dir, chunkedUpload.ID)
+
+		switch r.Method {
+		case "PUT":
+			part, err := strconv.Atoi(queryKeys.Get("part"))
+			if err != nil || part < 0 {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'part' is invalid")
+				return
+			}
+			if part >= options.maxChunkedParts() {
+				err = tooLargeError(fmt.Sprintf("an upload has at most %d parts", options.maxChunkedParts()))
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			err, room := chunkedRoom(dir, part, options.maxChunkedSize)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			tooLarge := tooLargeError(fmt.Sprintf("parts are larger than %d bytes", options.maxChunkedSize))
+			if room <= 0 {
+				responseErrorJSON(w, errorStatus(tooLarge), tooLarge.Error())
+				return
+			}
+			limit := options.maxSize
+			if room < limit {
+				limit = room
+			}
+
+			defer r.Body.Close()
+			body := newLimitedBody(r.Body, limit)
+			err = writeChunkedPart(dir, part, body)
+			if body.tooLarge() && limit < options.maxSize {
+				err = tooLarge
+			}
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			// parts written at the same time only see each other now
+			err, room = chunkedRoom(dir, -1, options.maxChunkedSize)
+			if err == nil && room < 0 {
+				os.Remove(chunkedPartPath(dir, part))
+				err = tooLarge
+			}
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+			fallthrough
+		case "GET":
+			err, parts := chunkedParts(dir)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			responseJSON(w, http.StatusOK, ChunkedUploadsResponse{ChunkedUploadResponse{
+				UploadID: chunkedUpload.ID,
+				PartSize: options.maxSize,
+				Parts:    parts,
+			}})
+		case "POST":
+			partCount, err := strconv.Atoi(queryKeys.Get("parts"))
+			if err != nil || partCount < 1 {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'parts' is invalid")
+				return
+			}
+
+			err, liveUpload := completeChunkedUpload(store, chunkedUpload, partCount, options)
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+			responseJSON(w, http.StatusOK, LiveUploadsResponse{LiveUploadResponse{
+				URL: liveViewURL + liveUpload.AssignProjectName,
+				Key: liveUpload.ManageKey,
+			}})
+		case "DELETE":
+			err = os.RemoveAll(dir)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			responseJSON(w, http.StatusOK, ChunkedUploadsResponse{ChunkedUploadResponse{UploadID: chunkedUpload.ID, Parts: []ChunkedPart{}}})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET, POST, PUT and DELETE methods are supported.")
+			return
+		}
+	}
+}
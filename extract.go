@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultMaxUploadSize        = 10000000
+	defaultMaxChunkedUploadSize = 1000000000
+)
+
+// uploadOptions are the limits of uploads taken from the config.
+type uploadOptions struct {
+	ttl int64
+	// a request body is refused beyond maxSize bytes, the parts of a
+	// chunked upload beyond maxChunkedSize bytes together
+	maxSize        int64
+	maxChunkedSize int64
+	limits         ExtractLimits
+	clone          CloneConfig
+	// dir holds the hosted recordings and chunked uploads
+	dir string
+}
+
+func (c Config) uploadOptions() uploadOptions {
+	options := uploadOptions{
+		ttl:            c.UploadTTL,
+		maxSize:        c.MaxUploadSize,
+		maxChunkedSize: c.MaxChunkedUploadSize,
+		limits:         c.Extract.withDefaults(),
+		clone:          c.Clone.withDefaults(),
+		dir:            liveLogPath,
+	}
+	if options.maxSize == 0 {
+		options.maxSize = defaultMaxUploadSize
+	}
+	if options.maxChunkedSize == 0 {
+		options.maxChunkedSize = defaultMaxChunkedUploadSize
+	}
+	return options
+}
+
+// maxChunkedParts is the most parts a chunked upload can need.
+func (o uploadOptions) maxChunkedParts() int {
+	return int((o.maxChunkedSize + o.maxSize - 1) / o.maxSize)
+}
+
+// ExtractLimits bounds what an uploaded tarball, pack or clone may unpack
+// to. The body limit only bounds the compressed size, these bound the
+// content.
+type ExtractLimits struct {
+	MaxFiles     int   `json:"maxFiles"`
+	MaxTotalSize int64 `json:"maxTotalSize"`
+	MaxDepth     int   `json:"maxDepth"`
+	MaxFileSize  int64 `json:"maxFileSize"`
+	// MaxObjects bounds the objects of an uploaded pack or bundle
+	MaxObjects int `json:"maxObjects"`
+}
+
+func (l ExtractLimits) withDefaults() ExtractLimits {
+	if l.MaxFiles == 0 {
+		l.MaxFiles = 20000
+	}
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = 200000000
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = 32
+	}
+	if l.MaxFileSize == 0 {
+		l.MaxFileSize = 50000000
+	}
+	if l.MaxObjects == 0 {
+		l.MaxObjects = 1000000
+	}
+	return l
+}
+
+// tooLargeError is answered with 413.
+type tooLargeError string
+
+func (e tooLargeError) Error() string {
+	return string(e)
+}
+
+// limitedBody reads at most limit bytes and fails with a tooLargeError
+// instead of stopping silently when there are more.
+type limitedBody struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func newLimitedBody(r io.Reader, limit int64) *limitedBody {
+	return &limitedBody{r: io.LimitReader(r, limit+1), limit: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.tooLarge() {
+		return n, b.err()
+	}
+	return n, err
+}
+
+// tooLarge also tells a reader that wrapped the error away what happened.
+func (b *limitedBody) tooLarge() bool {
+	return b.read > b.limit
+}
+
+func (b *limitedBody) err() error {
+	return tooLargeError(fmt.Sprintf("request body is larger than %d bytes", b.limit))
+}
+
+func pathDepth(name string) int {
+	return len(strings.Split(path.Clean(name), "/"))
+}
+
+// validLinkTarget reports whether the symlink name may point to target.
+// The target must be relative and stay inside the project, and every ".."
+// must come first: a ".." behind a directory that is itself a symlink
+// would climb out of the symlink's target instead.
+func validLinkTarget(name string, target string) bool {
+	if target == "" || strings.Contains(target, `\`) || path.IsAbs(target) || strings.Contains(target, "\x00") {
+		return false
+	}
+	climbing := true
+	for _, elem := range strings.Split(target, "/") {
+		if elem == ".." {
+			if !climbing {
+				return false
+			}
+			continue
+		}
+		if elem != "" && elem != "." {
+			climbing = false
+		}
+	}
+	resolved := path.Join(path.Dir(path.Clean(name)), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// checkRealParents makes sure no directory between dir and the entry rel is
+// a symlink, so entries are never written through one. realDirs remembers
+// the directories already checked.
+func checkRealParents(dir string, rel string, realDirs map[string]bool) error {
+	parent := dir
+	elems := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+	for _, elem := range elems {
+		if elem == "." {
+			continue
+		}
+		parent = filepath.Join(parent, elem)
+		if realDirs[parent] {
+			continue
+		}
+		fi, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			// created by MkdirAll as a real directory
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("tar entry %s is below the symlink %s", filepath.ToSlash(rel), elem)
+		}
+		realDirs[parent] = true
+	}
+	return nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+const (
+	uploadFormatTarball = "tarball"
+	uploadFormatBundle  = "bundle"
+	uploadFormatPack    = "pack"
+	uploadFormatClone   = "clone"
+)
+
+// cloning a large remote repository can take a while
+const cloneTimeout = 5 * time.Minute
+
+var (
+	gzipMagic     = []byte{0x1f, 0x8b}
+	bundleV2Magic = []byte("# v2 git bundle\n")
+	bundleV3Magic = []byte("# v3 git bundle\n")
+	packMagic     = []byte("PACK")
+)
+
+// detectUploadFormat trusts an explicit git content type and otherwise
+// looks at the magic bytes of the body. Anything else is treated as the
+// original gzip-compressed tarball.
+func detectUploadFormat(contentType string, head []byte) string {
+	switch contentType {
+	case "application/x-git-bundle":
+		return uploadFormatBundle
+	case "application/x-git-packfile":
+		return uploadFormatPack
+	}
+
+	if bytes.HasPrefix(head, gzipMagic) {
+		return uploadFormatTarball
+	}
+	if bytes.HasPrefix(head, bundleV2Magic) || bytes.HasPrefix(head, bundleV3Magic) {
+		return uploadFormatBundle
+	}
+	if bytes.HasPrefix(head, packMagic) {
+		return uploadFormatPack
+	}
+	return uploadFormatTarball
+}
+
+// importPack stores the objects of a git packfile in the repository. The
+// pack is spooled to a temp file and checked against the limits first:
+// its size only bounds the compressed objects, deltas can describe far
+// larger ones.
+func importPack(repo *git.Repository, r io.Reader, limits ExtractLimits) error {
+	spool, err := ioutil.TempFile("", "pack-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	_, err = io.Copy(spool, r)
+	if err != nil {
+		return err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = checkPack(spool, limits)
+	if err != nil {
+		return err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return packfile.UpdateObjectStorage(repo.Storer, spool)
+}
+
+// checkPack makes sure the objects of the pack stay within the object
+// count and total size of the limits, counting a delta by the size of the
+// object it builds. Nothing is resolved, so a delta bomb is caught before
+// it takes any memory.
+func checkPack(r io.Reader, limits ExtractLimits) error {
+	scanner := packfile.NewScanner(r)
+	_, objects, err := scanner.Header()
+	if err != nil {
+		return err
+	}
+	if int(objects) > limits.MaxObjects {
+		return tooLargeError(fmt.Sprintf("pack has more than %d objects", limits.MaxObjects))
+	}
+
+	budget := &packBudget{limit: limits.MaxTotalSize}
+	for i := uint32(0); i < objects; i++ {
+		header, err := scanner.NextObjectHeader()
+		if err != nil {
+			return err
+		}
+		delta := header.Type == plumbing.OFSDeltaObject || header.Type == plumbing.REFDeltaObject
+		budget.delta = delta
+		budget.head = budget.head[:0]
+		_, _, err = scanner.NextObject(budget)
+		if budget.exceeded {
+			return budget.err()
+		}
+		if err != nil {
+			return err
+		}
+		if delta {
+			// the delta data starts with the sizes of its base and target
+			_, rest := deltaSize(budget.head)
+			targetSize, _ := deltaSize(rest)
+			budget.size += targetSize
+			if budget.size > budget.limit {
+				return budget.err()
+			}
+		}
+	}
+	return nil
+}
+
+// packBudget counts the inflated bytes of the objects of a pack and keeps
+// the start of a delta to read its sizes.
+type packBudget struct {
+	limit    int64
+	size     int64
+	delta    bool
+	head     []byte
+	exceeded bool
+}
+
+func (b *packBudget) Write(p []byte) (int, error) {
+	if b.delta && len(b.head) < 20 {
+		n := 20 - len(b.head)
+		if n > len(p) {
+			n = len(p)
+		}
+		b.head = append(b.head, p[:n]...)
+	}
+	// delta data is counted too, it is inflated while reading
+	b.size += int64(len(p))
+	if b.size > b.limit {
+		b.exceeded = true
+		return 0, b.err()
+	}
+	return len(p), nil
+}
+
+func (b *packBudget) err() error {
+	return tooLargeError(fmt.Sprintf("pack objects are larger than %d bytes", b.limit))
+}
+
+// deltaSize reads a size of a delta header, little-endian groups of 7 bits.
+func deltaSize(data []byte) (int64, []byte) {
+	var size int64
+	for i, c := range data {
+		if i < 9 {
+			size |= int64(c&0x7f) << uint(7*i)
+		}
+		if c&0x80 == 0 {
+			return size, data[i+1:]
+		}
+	}
+	return size, nil
+}
+
+// importBundle reads a git bundle, a header listing the refs it contains
+// followed by a packfile, and returns the commit to replay: the bundled
+// HEAD, else master, else the first ref.
+func importBundle(repo *git.Repository, r io.Reader, limits ExtractLimits) (error, plumbing.Hash) {
+	br := bufio.NewReader(r)
+
+	signature, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("bundle header error: %v", err), plumbing.ZeroHash
+	}
+	if signature != string(bundleV2Magic) && signature != string(bundleV3Magic) {
+		return errors.New("not a git bundle"), plumbing.ZeroHash
+	}
+
+	refs := map[string]plumbing.Hash{}
+	var refNames []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("bundle header error: %v", err), plumbing.ZeroHash
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		switch line[0] {
+		case '@':
+			// v3 capability, e.g. @object-format=sha1
+			if line != "@object-format=sha1" {
+				return fmt.Errorf("unsupported bundle capability %q", line), plumbing.ZeroHash
+			}
+		case '-':
+			return errors.New("bundle has prerequisites, a complete bundle is required"), plumbing.ZeroHash
+		default:
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 || len(fields[0]) != 40 {
+				return fmt.Errorf("invalid bundle ref %q", line), plumbing.ZeroHash
+			}
+			refs[fields[1]] = plumbing.NewHash(fields[0])
+			refNames = append(refNames, fields[1])
+		}
+	}
+	if len(refNames) == 0 {
+		return errors.New("bundle has no refs"), plumbing.ZeroHash
+	}
+
+	err = importPack(repo, br, limits)
+	if err != nil {
+		return err, plumbing.ZeroHash
+	}
+
+	for _, name := range refNames {
+		if !strings.HasPrefix(name, "refs/") {
+			continue
+		}
+		err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), refs[name]))
+		if err != nil {
+			return err, plumbing.ZeroHash
+		}
+	}
+
+	if head, ok := refs["HEAD"]; ok {
+		return nil, head
+	}
+	if head, ok := refs["refs/heads/master"]; ok {
+		return nil, head
+	}
+	return nil, refs[refNames[0]]
+}
+
+// importGitUpload creates the hosted repository from a bundle or a raw
+// packfile, whose head commit the client passes as the head query. The
+// replayed commit ends up on master, which HEAD points to.
+func importGitUpload(hostedProjectPath string, uploadFormat string, body io.Reader, head string, limits ExtractLimits) error {
+	repo, err := git.PlainInit(hostedProjectPath, false)
+	if err != nil {
+		return err
+	}
+
+	headHash := plumbing.ZeroHash
+	switch uploadFormat {
+	case uploadFormatBundle:
+		err, headHash = importBundle(repo, body, limits)
+		if err != nil {
+			return err
+		}
+	case uploadFormatPack:
+		if len(head) != 40 {
+			return errors.New("url query 'head' is required for packfiles")
+		}
+		err = importPack(repo, body, limits)
+		if err != nil {
+			return err
+		}
+		headHash = plumbing.NewHash(head)
+	default:
+		return fmt.Errorf("unsupported upload format %s", uploadFormat)
+	}
+
+	_, err = repo.CommitObject(headHash)
+	if err != nil {
+		return fmt.Errorf("head commit %s: %v", headHash, err)
+	}
+
+	return repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("master"), headHash))
+}
+
+// CloneConfig restricts the urls a recording may be cloned from. Only
+// https remotes are cloned unless Schemes says otherwise; file urls need
+// their repository under one of FileRoots.
+type CloneConfig struct {
+	// Schemes of remotes that may be cloned: "https", "http", "ssh", "git"
+	Schemes []string `json:"schemes"`
+	// FileRoots are the directories file:// urls may point into
+	FileRoots []string `json:"fileRoots"`
+}
+
+func (c CloneConfig) withDefaults() CloneConfig {
+	if c.Schemes == nil {
+		c.Schemes = []string{"https"}
+	}
+	return c
+}
+
+func validCloneURL(gitURL string, config CloneConfig, liveLogDir string) error {
+	if strings.HasPrefix(gitURL, "file://") {
+		return validCloneFile(strings.TrimPrefix(gitURL, "file://"), config.FileRoots, liveLogDir)
+	}
+
+	scheme := ""
+	if i := strings.Index(gitURL, "://"); i > 0 {
+		scheme = gitURL[:i]
+	} else {
+		// scp-like ssh syntax, e.g. git@example.com:user/repo.git
+		at := strings.Index(gitURL, "@")
+		colon := strings.Index(gitURL, ":")
+		if at > 0 && colon > at && !strings.Contains(gitURL[:colon], "/") {
+			scheme = "ssh"
+		}
+	}
+	if scheme == "" {
+		return errors.New("url query 'url' must be a git url")
+	}
+	for _, allowed := range config.Schemes {
+		if scheme == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("cloning %s urls is not allowed", scheme)
+}
+
+// validCloneFile allows a local repository under one of the roots, but
+// never a hosted recording under liveLogDir.
+func validCloneFile(repoPath string, roots []string, liveLogDir string) error {
+	if !filepath.IsAbs(repoPath) {
+		return errors.New("file urls must be absolute")
+	}
+	realPath, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return errors.New("file url is not a repository")
+	}
+
+	absliveLogPath, err := filepath.Abs(liveLogDir)
+	if err != nil {
+		return err
+	}
+	if realLiveLogPath, err := filepath.EvalSymlinks(absliveLogPath); err == nil && pathWithin(realPath, realLiveLogPath) {
+		return errForbidden
+	}
+
+	for _, root := range roots {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err == nil && pathWithin(realPath, realRoot) {
+			return nil
+		}
+	}
+	return errors.New("cloning file urls is not allowed")
+}
+
+func pathWithin(p string, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// cloneProjectName names a cloned recording after its repository,
+// e.g. https://example.com/user/repo.git -> repo
+func cloneProjectName(gitURL string) string {
+	gitURL = strings.TrimSuffix(strings.TrimSuffix(gitURL, "/"), ".git")
+	if colon := strings.LastIndex(gitURL, ":"); colon > strings.LastIndex(gitURL, "/") {
+		gitURL = gitURL[colon+1:]
+	}
+	return path.Base(gitURL)
+}
+
+// cloneGitUpload clones the branch, or the remote HEAD when branch is
+// empty, into the hosted path. What the clone writes is bounded by the
+// file count and total size of the limits.
+func cloneGitUpload(hostedProjectPath string, gitURL string, branch string, limits ExtractLimits) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cloneTimeout)
+	defer cancel()
+
+	cloneOptions := &git.CloneOptions{
+		URL:          gitURL,
+		SingleBranch: true,
+	}
+	if branch != "" {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(branch)
+	}
+
+	quota := &cloneQuota{limits: limits}
+	worktree := quotaFS{Filesystem: osfs.New(hostedProjectPath), quota: quota}
+	dot, err := worktree.Chroot(git.GitDirName)
+	if err != nil {
+		return err
+	}
+
+	_, err = git.CloneContext(ctx, filesystem.NewStorage(dot, cache.NewObjectLRUDefault()), worktree, cloneOptions)
+	// go-git does not always pass the write error through
+	if quotaErr := quota.err(); quotaErr != nil {
+		return quotaErr
+	}
+	return err
+}
+
+// cloneQuota counts the files and bytes a clone writes.
+type cloneQuota struct {
+	limits ExtractLimits
+
+	mu       sync.Mutex
+	files    int
+	size     int64
+	exceeded error
+}
+
+func (q *cloneQuota) addFile() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.files++
+	if q.files > q.limits.MaxFiles && q.exceeded == nil {
+		q.exceeded = tooLargeError(fmt.Sprintf("clone has more than %d files", q.limits.MaxFiles))
+	}
+	return q.exceeded
+}
+
+func (q *cloneQuota) addSize(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.size += int64(n)
+	if q.size > q.limits.MaxTotalSize && q.exceeded == nil {
+		q.exceeded = tooLargeError(fmt.Sprintf("clone is larger than %d bytes", q.limits.MaxTotalSize))
+	}
+	return q.exceeded
+}
+
+func (q *cloneQuota) err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.exceeded
+}
+
+// quotaFS is the filesystem a clone writes the repository and worktree
+// through.
+type quotaFS struct {
+	billy.Filesystem
+	quota *cloneQuota
+}
+
+func (fs quotaFS) Create(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs quotaFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&os.O_CREATE != 0 {
+		if _, err := fs.Filesystem.Lstat(filename); os.IsNotExist(err) {
+			if err := fs.quota.addFile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	file, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return quotaFile{File: file, quota: fs.quota}, nil
+}
+
+func (fs quotaFS) TempFile(dir string, prefix string) (billy.File, error) {
+	if err := fs.quota.addFile(); err != nil {
+		return nil, err
+	}
+	file, err := fs.Filesystem.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return quotaFile{File: file, quota: fs.quota}, nil
+}
+
+func (fs quotaFS) Chroot(path string) (billy.Filesystem, error) {
+	chroot, err := fs.Filesystem.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return quotaFS{Filesystem: chroot, quota: fs.quota}, nil
+}
+
+type quotaFile struct {
+	billy.File
+	quota *cloneQuota
+}
+
+func (f quotaFile) Write(p []byte) (int, error) {
+	if err := f.quota.addSize(len(p)); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
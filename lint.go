@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// Warning is a problem of an annotation in one file of a frame.
+type Warning struct {
+	File    string `json:"file"`
+	Hash    string `json:"hash"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type LintResponse struct {
+	ID       string    `json:"id"`
+	Frames   int       `json:"frames"`
+	Warnings []Warning `json:"warnings"`
+}
+
+type LintsResponse []LintResponse
+
+// lintFiles lists the warnings of a snapshot keyed by repository path,
+// ordered by file and line. Files are reported under projectName.
+func lintFiles(hash string, snapshot map[string]FileInfo, projectName string) []Warning {
+	warnings := []Warning{}
+	for filePath, info := range snapshot {
+		file := projectName + "/" + filePath
+		for _, annotationError := range info.AnnotationErrors {
+			warnings = append(warnings, Warning{File: file, Hash: hash, Line: annotationError.Line, Message: annotationError.Message})
+		}
+		for _, annotation := range info.Annotations {
+			if annotation.File == "" {
+				continue
+			}
+			if _, ok := snapshot[path.Clean(annotation.File)]; !ok {
+				warnings = append(warnings, Warning{File: file, Hash: hash, Line: annotation.Line, Message: "focus file " + annotation.File + " is not in the recording"})
+			}
+		}
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].File != warnings[j].File {
+			return warnings[i].File < warnings[j].File
+		}
+		return warnings[i].Line < warnings[j].Line
+	})
+	return warnings
+}
+
+// lintRecording collects the warnings of every frame of the recording. A
+// warning that stays over several frames is reported once, with the hash
+// of the frame it first appears in.
+func lintRecording(liveUpload LiveUpload, livesResponse LivesResponse) (error, LintResponse) {
+	repo, err := git.PlainOpen(liveUpload.HostedProjectPath)
+	if err != nil {
+		return err, LintResponse{}
+	}
+
+	type warningKey struct {
+		file    string
+		line    int
+		message string
+	}
+	seen := map[warningKey]bool{}
+	warnings := []Warning{}
+	for _, liveResponse := range livesResponse {
+		err, snapshot := readSnapshot(repo, liveUpload.HostedProjectPath, liveResponse.Hash)
+		if err != nil {
+			return err, LintResponse{}
+		}
+		for _, warning := range lintFiles(liveResponse.Hash, snapshot, liveUpload.OriginalProjectName) {
+			key := warningKey{warning.File, warning.Line, warning.Message}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			warnings = append(warnings, warning)
+		}
+	}
+
+	return nil, LintResponse{
+		ID:       liveUpload.AssignProjectName,
+		Frames:   len(livesResponse),
+		Warnings: warnings,
+	}
+}
+
+// liveLintRequest reports every invalid or unknown annotation of a
+// recording so its author can fix them.
+func liveLintRequest(store Store, auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "GET":
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'id' is missing")
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err, liveUpload, livesResponse := findLiveCommits(ctx, store, id, auth.user(r), ReplayQuery{})
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			err, lintResponse := lintRecording(liveUpload, livesResponse)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			responseJSON(w, http.StatusOK, LintsResponse{lintResponse})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET method is supported.")
+			return
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LivePatchRequest changes an upload. Missing fields are left alone, an
+// ExpiresAt of 0 removes the expiry.
+type LivePatchRequest struct {
+	ProjectName *string `json:"projectName"`
+	Visibility  *string `json:"visibility"`
+	// ExpiresAt is in milliseconds
+	ExpiresAt *int64 `json:"expiresAt"`
+}
+
+const janitorInterval = time.Minute
+
+// canModify allows the owner, or whoever holds the key returned when the
+// recording was created. Without tokens the key is the only way in.
+func (a *authenticator) canModify(r *http.Request, liveUpload LiveUpload) bool {
+	if user := a.user(r); user != "" && user == liveUpload.Owner {
+		return true
+	}
+	key := r.URL.Query().Get("key")
+	return key != "" && (key == liveUpload.ManageKey || key == liveUpload.SessionKey)
+}
+
+func (u LiveUpload) expired(now int64) bool {
+	return u.ExpiresAt > 0 && u.ExpiresAt <= now
+}
+
+// deleteRecording removes the hosted repo, its snapshots and all documents
+// of the upload. The repo is first moved aside so a failing store leaves
+// the recording as it was.
+func deleteRecording(ctx context.Context, store Store, hub *sessionHub, liveUpload LiveUpload) error {
+	trashPath := filepath.Join(filepath.Dir(liveUpload.HostedProjectPath), ".trash", liveUpload.AssignProjectName)
+	err := os.MkdirAll(filepath.Dir(trashPath), 0775)
+	if err != nil {
+		return err
+	}
+
+	moved := true
+	err = os.Rename(liveUpload.HostedProjectPath, trashPath)
+	if os.IsNotExist(err) {
+		moved = false
+	} else if err != nil {
+		return err
+	}
+
+	err = store.DeleteUpload(ctx, liveUpload)
+	if err != nil {
+		if moved {
+			os.Rename(trashPath, liveUpload.HostedProjectPath)
+		}
+		return err
+	}
+
+	hub.close(liveUpload.AssignProjectName)
+
+	err = os.RemoveAll(trashPath)
+	if err != nil {
+		log.Printf("error removing %s: %v", trashPath, err)
+	}
+	err = removeSnapshots(liveUpload.HostedProjectPath)
+	if err != nil {
+		log.Printf("error removing snapshots of %s: %v", liveUpload.HostedProjectPath, err)
+	}
+	return nil
+}
+
+func patchRecording(liveUpload *LiveUpload, patch LivePatchRequest) error {
+	if patch.ProjectName != nil {
+		projectName := *patch.ProjectName
+		if projectName == "" || strings.Contains(projectName, "/") || strings.Contains(projectName, "\\") {
+			return errors.New("invalid projectName.")
+		}
+		liveUpload.OriginalProjectName = projectName
+	}
+	if patch.Visibility != nil {
+		err := validVisibility(*patch.Visibility, liveUpload.Owner)
+		if err != nil {
+			return err
+		}
+		liveUpload.Visibility = *patch.Visibility
+	}
+	if patch.ExpiresAt != nil {
+		if *patch.ExpiresAt < 0 {
+			return errors.New("expiresAt must not be negative")
+		}
+		liveUpload.ExpiresAt = *patch.ExpiresAt
+	}
+	return nil
+}
+
+// manageUpload serves DELETE and PATCH on /api/live/upload?id=...&key=...
+func manageUpload(w http.ResponseWriter, r *http.Request, store Store, auth *authenticator, hub *sessionHub) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		responseErrorJSON(w, http.StatusInternalServerError, "url query 'id' is missing")
+		return
+	}
+
+	// the body is read before taking the lock, a slow client must not
+	// hold up the appends
+	patch := LivePatchRequest{}
+	if r.Method == "PATCH" {
+		requestBody, err := ioutil.ReadAll(io.LimitReader(r.Body, 100000))
+		defer r.Body.Close()
+		if err != nil {
+			responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		err = json.Unmarshal(requestBody, &patch)
+		if err != nil {
+			responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// an append of a live session must not write back an old copy
+	defer hub.lock(id)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err, liveUpload := store.FindUpload(ctx, id)
+	if err != nil {
+		responseErrorJSON(w, errorStatus(err), err.Error())
+		return
+	}
+	if !auth.canModify(r, liveUpload) {
+		responseErrorJSON(w, http.StatusForbidden, errForbidden.Error())
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = deleteRecording(ctx, store, hub, liveUpload)
+		if err != nil {
+			responseErrorJSON(w, errorStatus(err), err.Error())
+			return
+		}
+		responseJSON(w, http.StatusOK, LiveUploadsResponse{})
+		return
+	}
+
+	err = patchRecording(&liveUpload, patch)
+	if err != nil {
+		responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = store.UpdateUpload(ctx, liveUpload)
+	if err != nil {
+		responseErrorJSON(w, errorStatus(err), err.Error())
+		return
+	}
+
+	responseJSON(w, http.StatusOK, LiveUploadsResponse{LiveUploadResponse{URL: liveViewURL + id}})
+}
+
+// runJanitor deletes expired recordings until ctx is done.
+func runJanitor(ctx context.Context, store Store, hub *sessionHub, options uploadOptions) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		sweepExpired(ctx, store, hub)
+		sweepChunkedUploads(options.dir)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func sweepExpired(ctx context.Context, store Store, hub *sessionHub) {
+	ctx, cancel := context.WithTimeout(ctx, janitorInterval)
+	defer cancel()
+
+	err, liveUploads := store.FindExpiredUploads(ctx, nowMillis())
+	if err != nil {
+		log.Printf("error finding expired uploads: %v", err)
+		return
+	}
+
+	for _, liveUpload := range liveUploads {
+		unlock := hub.lock(liveUpload.AssignProjectName)
+		err = deleteRecording(ctx, store, hub, liveUpload)
+		unlock()
+		if err != nil {
+			log.Printf("error deleting expired upload %s: %v", liveUpload.AssignProjectName, err)
+		}
+	}
+}
@@ -2,29 +2,31 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
+	"bufio"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"liveCoding-api/util"
 	"log"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
@@ -34,6 +36,23 @@ type Config struct {
 	Schema string `json:"schema"`
 	Host   string `json:"host"`
 	Port   string `json:"port"`
+	// Storage is "mongo" (default) or "file"
+	Storage string      `json:"storage"`
+	Mongo   MongoConfig `json:"mongo"`
+	// TokensPath enables authentication with the tokens listed in the file
+	TokensPath string `json:"tokensPath"`
+	// UploadTTL in seconds expires new uploads unless they ask for a ttl
+	UploadTTL int64 `json:"uploadTTL"`
+	// MaxUploadSize in bytes bounds a request body, 10MB by default
+	MaxUploadSize int64 `json:"maxUploadSize"`
+	// MaxChunkedUploadSize in bytes bounds all parts of a chunked upload
+	MaxChunkedUploadSize int64 `json:"maxChunkedUploadSize"`
+	// LanguagesPath adds or replaces languages with the ones in the file
+	LanguagesPath string `json:"languagesPath"`
+	// Extract overrides the default quotas of uploaded tarballs and clones
+	Extract ExtractLimits `json:"extract"`
+	// Clone limits the urls recordings are cloned from
+	Clone CloneConfig `json:"clone"`
 }
 
 type Configs struct {
@@ -50,22 +69,75 @@ type LiveRequest struct {
 // }
 
 type FileInfo struct {
-	Code     string        `json:"code" bson:"code"`
-	Lang     string        `json:"lang" bson:"lang"`
-	Commands util.Commands `json:"commands" bson:"commands"`
+	Code string `json:"code" bson:"code"`
+	Lang string `json:"lang" bson:"lang"`
+	// LangConfidence from 0 to 1 tells how sure the detection of Lang is
+	LangConfidence float64       `json:"langConfidence" bson:"lang_confidence"`
+	Commands       util.Commands `json:"commands" bson:"commands"`
+	// Annotations lists every annotation comment of the code in order,
+	// AnnotationErrors the ones that could not be used
+	Annotations      []util.Annotation      `json:"annotations,omitempty" bson:"annotations"`
+	AnnotationErrors []util.AnnotationError `json:"annotationErrors,omitempty" bson:"annotation_errors,omitempty"`
+	// Terminal is the transcript of a .cui.log as prompts, commands,
+	// output and exit statuses
+	Terminal []util.TerminalEvent `json:"terminal,omitempty" bson:"terminal,omitempty"`
 }
 
+// FilePatch is the change of one file against the previous frame.
+// Added files carry the whole code, changed files only the hunks; removed
+// files only the status and language.
+type FilePatch struct {
+	Status           string                 `json:"status"`
+	Code             string                 `json:"code,omitempty"`
+	Hunks            []util.Hunk            `json:"hunks,omitempty"`
+	Lang             string                 `json:"lang,omitempty"`
+	LangConfidence   float64                `json:"langConfidence,omitempty"`
+	Commands         *util.Commands         `json:"commands,omitempty"`
+	Annotations      []util.Annotation      `json:"annotations,omitempty"`
+	AnnotationErrors []util.AnnotationError `json:"annotationErrors,omitempty"`
+	// a changed transcript only carries its events from TerminalFrom on
+	Terminal     []util.TerminalEvent `json:"terminal,omitempty"`
+	TerminalFrom int                  `json:"terminalFrom,omitempty"`
+}
+
+const (
+	filePatchAdded   = "added"
+	filePatchRemoved = "removed"
+	filePatchChanged = "changed"
+)
+
 type LiveResponse struct {
-	ProjectPath string              `json:"projectPath" bson:"project_path"`
-	ProjectName string              `json:"projectName" bson:"project_name"`
-	Hash        string              `json:"hash" bson:"hash"`
-	Time        int64               `json:"time" bson:"time"`
-	ID          int                 `json:"id" bson:"id"`
-	Files       map[string]FileInfo `json:"files" bson:"files"`
+	ProjectPath string               `json:"projectPath" bson:"project_path"`
+	ProjectName string               `json:"projectName" bson:"project_name"`
+	Hash        string               `json:"hash" bson:"hash"`
+	Time        int64                `json:"time" bson:"time"`
+	ID          int                  `json:"id" bson:"id"`
+	Files       map[string]FileInfo  `json:"files,omitempty" bson:"files"`
+	Patches     map[string]FilePatch `json:"patches,omitempty" bson:"-"`
+	// Warnings lists the broken annotations of the frame
+	Warnings []Warning `json:"warnings" bson:"-"`
 }
 
 type LivesResponse []LiveResponse
 
+// LivePageResponse is returned instead of a bare LivesResponse when the
+// client pages through a recording. NextCursor is nil on the last page.
+type LivePageResponse struct {
+	Frames     LivesResponse `json:"frames"`
+	NextCursor *int          `json:"nextCursor"`
+}
+
+// ReplayQuery selects the frames of a recording. Cursor is the commit ID
+// to start from, From and To bound the commit time.
+type ReplayQuery struct {
+	Format string
+	Cursor int
+	Limit  int
+	From   *int64
+	To     *int64
+	Paged  bool
+}
+
 type ErrorResponse struct {
 	Message string `json:"message"`
 }
@@ -76,14 +148,72 @@ type LiveUpload struct {
 	AssignProjectName   string `json:"assignProjectName" bson:"assign_project_name"`
 	OriginalProjectName string `json:"originalProjectName" bson:"original_project_name"`
 	HostedProjectPath   string `json:"hostedProjectPath" bson:"hosted_project_path"`
+	// Status is empty for finished uploads
+	Status     string `json:"status,omitempty" bson:"status,omitempty"`
+	SessionKey string `json:"sessionKey,omitempty" bson:"session_key,omitempty"`
+	// ManageKey lets whoever uploaded the recording delete or change it
+	// when there are no tokens to tell the owner
+	ManageKey string `json:"manageKey,omitempty" bson:"manage_key,omitempty"`
+	// summary for the listing, times in milliseconds like commit times
+	CreatedAt   int64    `json:"createdAt" bson:"created_at"`
+	CommitCount int      `json:"commitCount" bson:"commit_count"`
+	StartTime   int64    `json:"startTime" bson:"start_time"`
+	EndTime     int64    `json:"endTime" bson:"end_time"`
+	Duration    int64    `json:"duration" bson:"duration"`
+	Languages   []string `json:"languages" bson:"languages"`
+	Size        int64    `json:"size" bson:"size"`
+	// Owner is empty for anonymous uploads
+	Owner      string `json:"owner,omitempty" bson:"owner,omitempty"`
+	Visibility string `json:"visibility,omitempty" bson:"visibility,omitempty"`
+	// ExpiresAt is in milliseconds, 0 keeps the recording forever
+	ExpiresAt int64 `json:"expiresAt,omitempty" bson:"expires_at,omitempty"`
 }
 
+const (
+	uploadStatusLive   = "live"
+	uploadStatusClosed = "closed"
+)
+
 type LiveUploadResponse struct {
 	URL string `json:"url"`
+	// Key is the manage key, only sent when the recording is created
+	Key string `json:"key,omitempty"`
 }
 
 type LiveUploadsResponse []LiveUploadResponse
 
+type LiveListItem struct {
+	ID          string   `json:"id"`
+	ProjectName string   `json:"projectName"`
+	URL         string   `json:"url"`
+	Status      string   `json:"status,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+	Visibility  string   `json:"visibility"`
+	CreatedAt   int64    `json:"createdAt"`
+	CommitCount int      `json:"commitCount"`
+	Duration    int64    `json:"duration"`
+	Languages   []string `json:"languages"`
+	Size        int64    `json:"size"`
+}
+
+type LiveListResponse []LiveListItem
+
+// UploadQuery filters and orders the listing. Name matches part of the
+// original project name, Lang one of the languages used.
+type UploadQuery struct {
+	// Viewer also sees their own unlisted and private recordings
+	Viewer string
+	Name   string
+	Lang   string
+	Sort   string
+	Desc   bool
+}
+
+const (
+	uploadSortDate   = "date"
+	uploadSortLength = "length"
+)
+
 type Commit struct {
 	ProjectPath string `bson:"project_path"`
 	ProjectName string `bson:"project_name"`
@@ -96,8 +226,37 @@ type Commit struct {
 
 type Commits []Commit
 
+func (c Commit) liveResponse() LiveResponse {
+	return LiveResponse{
+		ProjectPath: c.ProjectPath,
+		ProjectName: c.ProjectName,
+		Hash:        c.Hash,
+		Time:        c.Time,
+		ID:          c.ID,
+	}
+}
+
 const liveLogPath = "livelog"
 
+const liveViewURL = "https://live-coding.takukitamura.com/?id="
+
+const (
+	assignProjectNameLength = 20
+	maxAssignAttempts       = 5
+)
+
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+const (
+	replayFormatFull = "full"
+	replayFormatDiff = "diff"
+)
+
+const (
+	defaultReplayLimit = 100
+	maxReplayLimit     = 1000
+)
+
 func responseJSON(w http.ResponseWriter, code int, data interface{}) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
@@ -120,53 +279,367 @@ func responseErrorJSON(w http.ResponseWriter, code int, message string) {
 
 func CORSforOptions(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	(*w).WriteHeader(204)
 }
 
-func dirwalk(dir string) (error, []string) {
-	files, err := ioutil.ReadDir(dir)
+// readCommitFiles reads every file of the commit straight from the git
+// objects, so replays never touch the working tree of the hosted repo.
+// The files are keyed by their path inside the repository.
+func readCommitFiles(repo *git.Repository, hash string) (error, map[string]FileInfo) {
+	commitObject, err := repo.CommitObject(plumbing.NewHash(hash))
 	if err != nil {
 		return err, nil
 	}
-	var paths []string
-	for _, file := range files {
-		fileName := file.Name()
-		filePathJoin := filepath.Join(dir, fileName)
-		if file.IsDir() {
-			err, tempPaths := dirwalk(filePathJoin)
-			if err != nil {
-				return err, nil
+
+	fileIter, err := commitObject.Files()
+	if err != nil {
+		return err, nil
+	}
+	defer fileIter.Close()
+
+	fileInfo := map[string]FileInfo{}
+	err = fileIter.ForEach(func(file *object.File) error {
+		code, err := file.Contents()
+		if err != nil {
+			return err
+		}
+
+		baseName := path.Base(file.Name)
+		detection := util.Languages.Detect(file.Name, code)
+		lang := detection.Lang
+
+		// unsupported languages just have no annotations
+		err, annotations, annotationErrors := util.ParseAnnotations(code, lang, baseName)
+		if err != nil {
+			annotations = []util.Annotation{}
+		}
+
+		info := FileInfo{
+			Code:             code,
+			Lang:             lang,
+			LangConfidence:   detection.Confidence,
+			Commands:         util.HeadingCommands(annotations),
+			Annotations:      annotations,
+			AnnotationErrors: annotationErrors,
+		}
+		if baseName == ".cui.log" {
+			info.Terminal = util.ParseTerminal(code)
+		}
+		fileInfo[file.Name] = info
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, fileInfo
+}
+
+func diffFiles(prev map[string]FileInfo, next map[string]FileInfo) map[string]FilePatch {
+	patches := map[string]FilePatch{}
+	for path, prevInfo := range prev {
+		if _, ok := next[path]; !ok {
+			patches[path] = FilePatch{Status: filePatchRemoved, Lang: prevInfo.Lang}
+		}
+	}
+	for path, nextInfo := range next {
+		commands := nextInfo.Commands
+		prevInfo, ok := prev[path]
+		if !ok {
+			patches[path] = FilePatch{
+				Status:           filePatchAdded,
+				Code:             nextInfo.Code,
+				Lang:             nextInfo.Lang,
+				LangConfidence:   nextInfo.LangConfidence,
+				Commands:         &commands,
+				Annotations:      nextInfo.Annotations,
+				AnnotationErrors: nextInfo.AnnotationErrors,
+				Terminal:         nextInfo.Terminal,
 			}
+			continue
+		}
+		if prevInfo.Code == nextInfo.Code {
+			continue
+		}
+		terminalFrom, terminal := util.NewTerminalEvents(prevInfo.Terminal, nextInfo.Terminal)
+		patches[path] = FilePatch{
+			Status:           filePatchChanged,
+			Hunks:            util.DiffLines(prevInfo.Code, nextInfo.Code),
+			Lang:             nextInfo.Lang,
+			LangConfidence:   nextInfo.LangConfidence,
+			Commands:         &commands,
+			Annotations:      nextInfo.Annotations,
+			AnnotationErrors: nextInfo.AnnotationErrors,
+			Terminal:         terminal,
+			TerminalFrom:     terminalFrom,
+		}
+	}
+	return patches
+}
+
+func parseReplayQuery(query url.Values) (error, ReplayQuery) {
+	// the first frame is always a full snapshot, later frames only
+	// carry patches unless an old client asks for format=full
+	replayQuery := ReplayQuery{Format: query.Get("format")}
+	if replayQuery.Format == "" {
+		replayQuery.Format = replayFormatDiff
+	}
+	if replayQuery.Format != replayFormatFull && replayQuery.Format != replayFormatDiff {
+		return errors.New("url query 'format' must be 'full' or 'diff'"), replayQuery
+	}
 
-			paths = append(paths, tempPaths...)
+	for _, key := range []string{"cursor", "limit", "from", "to"} {
+		value := query.Get(key)
+		if value == "" {
 			continue
 		}
-		paths = append(paths, filePathJoin)
+		replayQuery.Paged = true
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("url query '%s' is invalid", key), replayQuery
+		}
+
+		switch key {
+		case "cursor":
+			replayQuery.Cursor = int(n)
+		case "limit":
+			replayQuery.Limit = int(n)
+		case "from":
+			replayQuery.From = &n
+		case "to":
+			replayQuery.To = &n
+		}
+	}
+
+	if replayQuery.Paged && (replayQuery.Limit == 0 || replayQuery.Limit > maxReplayLimit) {
+		if replayQuery.Limit == 0 {
+			replayQuery.Limit = defaultReplayLimit
+		} else {
+			replayQuery.Limit = maxReplayLimit
+		}
+	}
+
+	return nil, replayQuery
+}
+
+func findLiveCommits(ctx context.Context, store Store, id string, user string, replayQuery ReplayQuery) (error, LiveUpload, LivesResponse) {
+	err, liveUpload := store.FindUpload(ctx, id)
+	if err != nil {
+		return err, liveUpload, nil
+	}
+	if liveUpload.expired(nowMillis()) {
+		return errNotFound, LiveUpload{}, nil
+	}
+	if !liveUpload.canView(user) {
+		return errForbidden, LiveUpload{}, nil
+	}
+
+	limit := 0
+	if replayQuery.Limit > 0 {
+		// one extra commit tells whether there is a next page
+		limit = replayQuery.Limit + 1
+	}
+	err, commits := store.FindCommits(ctx, liveUpload.HostedProjectPath, replayQuery, limit)
+	if err != nil {
+		return err, liveUpload, nil
+	}
+
+	livesResponse := LivesResponse{}
+	for _, commit := range commits {
+		liveResponse := commit.liveResponse()
+		// the upload may have been renamed since
+		liveResponse.ProjectName = liveUpload.OriginalProjectName
+		livesResponse = append(livesResponse, liveResponse)
+	}
+
+	return nil, liveUpload, livesResponse
+}
+
+// frameBuilder turns commit documents into replay frames one at a time,
+// so callers never need to hold more than the previous snapshot.
+type frameBuilder struct {
+	repo              *git.Repository
+	hostedProjectPath string
+	projectName       string
+	format            string
+	prevFileInfo      map[string]FileInfo
+}
+
+func newFrameBuilder(liveUpload LiveUpload, format string) (error, *frameBuilder) {
+	repo, err := git.PlainOpen(liveUpload.HostedProjectPath)
+	if err != nil {
+		return err, nil
 	}
 
-	return nil, paths
+	return nil, &frameBuilder{
+		repo:              repo,
+		hostedProjectPath: liveUpload.HostedProjectPath,
+		projectName:       liveUpload.OriginalProjectName,
+		format:            format,
+	}
 }
 
-func randomText(length int) string {
-	rand.Seed(time.Now().UnixNano())
+func (b *frameBuilder) build(liveResponse LiveResponse) (error, LiveResponse) {
+	err, snapshot := readSnapshot(b.repo, b.hostedProjectPath, liveResponse.Hash)
+	if err != nil {
+		return err, liveResponse
+	}
+
+	fileInfo := map[string]FileInfo{}
+	for path, info := range snapshot {
+		fileInfo[b.projectName+"/"+path] = info
+	}
+
+	if b.format == replayFormatFull || b.prevFileInfo == nil {
+		liveResponse.Files = fileInfo
+	} else {
+		liveResponse.Patches = diffFiles(b.prevFileInfo, fileInfo)
+	}
+	b.prevFileInfo = fileInfo
+	liveResponse.Warnings = lintFiles(liveResponse.Hash, snapshot, b.projectName)
+
+	liveResponse.ProjectPath = ""
+	return nil, liveResponse
+}
+
+// commitTime reads the recording time the client stores as the commit
+// message, -1 when the message is not a number.
+func commitTime(commitObject *object.Commit) int64 {
+	t, err := strconv.ParseInt(strings.TrimSpace(commitObject.Message), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return t
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// addCommits updates the listing summary with newly stored commits.
+func (u *LiveUpload) addCommits(commits Commits) {
+	u.CommitCount += len(commits)
+	for _, commit := range commits {
+		if commit.Time < 0 {
+			continue
+		}
+		if u.StartTime == 0 || commit.Time < u.StartTime {
+			u.StartTime = commit.Time
+		}
+		if commit.Time > u.EndTime {
+			u.EndTime = commit.Time
+		}
+	}
+	u.Duration = u.EndTime - u.StartTime
+}
+
+// describeHead records the languages and the size of the latest commit.
+func (u *LiveUpload) describeHead(repo *git.Repository, hash string) error {
+	err, snapshot := readSnapshot(repo, u.HostedProjectPath, hash)
+	if err != nil {
+		return err
+	}
+
+	langs := map[string]bool{}
+	u.Size = 0
+	for _, info := range snapshot {
+		langs[info.Lang] = true
+		u.Size += int64(len(info.Code))
+	}
+
+	u.Languages = []string{}
+	for lang := range langs {
+		u.Languages = append(u.Languages, lang)
+	}
+	sort.Strings(u.Languages)
+	return nil
+}
+
+// randomText returns a random alphanumeric string from crypto/rand.
+func randomText(length int) (error, string) {
 	const charSet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charSet[rand.Intn(len(charSet))]
+	// larger bytes are skipped so every character is equally likely
+	const maxByte = 256 - 256%len(charSet)
+
+	b := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(b) < length {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return err, ""
+		}
+		for _, c := range buf {
+			if int(c) < maxByte && len(b) < length {
+				b = append(b, charSet[int(c)%len(charSet)])
+			}
+		}
+	}
+
+	return nil, string(b)
+}
+
+// reserveProjectName picks the id of a new recording and creates its
+// hosted directory, which fails if another upload got the id first. A
+// vanity slug is used as is when it is free.
+func reserveProjectName(store Store, absliveLogPath string, slug string) (error, string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if slug != "" && !slugPattern.MatchString(slug) {
+		return errors.New("slug must be 3 to 64 letters, digits, '-' or '_'"), "", ""
+	}
+
+	for i := 0; i < maxAssignAttempts; i++ {
+		assignProjectName := slug
+		if assignProjectName == "" {
+			var err error
+			err, assignProjectName = randomText(assignProjectNameLength)
+			if err != nil {
+				return err, "", ""
+			}
+		}
+
+		err, _ := store.FindUpload(ctx, assignProjectName)
+		if err == nil {
+			if slug != "" {
+				return errDuplicate, "", ""
+			}
+			continue
+		}
+		if err != errNotFound {
+			return err, "", ""
+		}
+
+		hostedProjectPath := absliveLogPath + "/" + assignProjectName
+		err = os.Mkdir(hostedProjectPath, 0775)
+		if os.IsExist(err) {
+			if slug != "" {
+				return errDuplicate, "", ""
+			}
+			continue
+		}
+		if err != nil {
+			return err, "", ""
+		}
+		return nil, assignProjectName, hostedProjectPath
 	}
 
-	return string(b)
+	return errors.New("could not assign a project name"), "", ""
 }
 
 // Copyright 2017 The Go Authors. All rights reserved.
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
-func untar(r io.Reader, dir string) (err error) {
+func untar(r io.Reader, dir string, limits ExtractLimits) (err error) {
 	t0 := time.Now()
 	nFiles := 0
+	nEntries := 0
+	var totalSize int64
 	madeDir := map[string]bool{}
+	realDirs := map[string]bool{}
 	defer func() {
 		td := time.Since(t0)
 		if err == nil {
@@ -193,13 +666,36 @@ func untar(r io.Reader, dir string) (err error) {
 		if !validRelPath(f.Name) {
 			return fmt.Errorf("tar contained invalid name error %q", f.Name)
 		}
+		nEntries++
+		if nEntries > limits.MaxFiles {
+			return tooLargeError(fmt.Sprintf("tar has more than %d entries", limits.MaxFiles))
+		}
+		if pathDepth(f.Name) > limits.MaxDepth {
+			return tooLargeError(fmt.Sprintf("tar entry %s is nested deeper than %d", f.Name, limits.MaxDepth))
+		}
 		rel := filepath.FromSlash(f.Name)
 		abs := filepath.Join(dir, rel)
+		if err := checkRealParents(dir, rel, realDirs); err != nil {
+			return err
+		}
 
 		fi := f.FileInfo()
 		mode := fi.Mode()
 		switch {
+		case f.Typeflag == tar.TypeLink:
+			return fmt.Errorf("tar file entry %s is a hard link", f.Name)
 		case mode.IsRegular():
+			if f.Size > limits.MaxFileSize {
+				return tooLargeError(fmt.Sprintf("tar entry %s is larger than %d bytes", f.Name, limits.MaxFileSize))
+			}
+			totalSize += f.Size
+			if totalSize > limits.MaxTotalSize {
+				return tooLargeError(fmt.Sprintf("tar unpacks to more than %d bytes", limits.MaxTotalSize))
+			}
+			// opening would follow a symlink of an earlier entry
+			if fi, err := os.Lstat(abs); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("tar file entry %s replaces a symlink", f.Name)
+			}
 			// Make the directory. This is redundant because it should
 			// already be made by a directory entry in the tar
 			// beforehand. Thus, don't check for errors; the next
@@ -250,6 +746,16 @@ func untar(r io.Reader, dir string) (err error) {
 				return err
 			}
 			madeDir[abs] = true
+		case mode&os.ModeSymlink != 0:
+			if !validLinkTarget(f.Name, f.Linkname) {
+				return fmt.Errorf("tar symlink %s points outside the project to %q", f.Name, f.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(f.Linkname, abs); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("tar file entry %s contained unsupported file type %v", f.Name, mode)
 		}
@@ -257,6 +763,36 @@ func untar(r io.Reader, dir string) (err error) {
 	return nil
 }
 
+// extractTarball unpacks a gzip-compressed tar of the project directory
+// into the hosted path. Replays read the git objects, so the working tree
+// is left as uploaded. The config and hooks of the uploaded repo are
+// removed: they could make git or go-git run commands or read other
+// repositories. It never changes the working directory of the server,
+// concurrent requests rely on it.
+func extractTarball(r io.Reader, hostedProjectPath string, limits ExtractLimits) error {
+	err := untar(r, hostedProjectPath, limits)
+	if _, ok := err.(tooLargeError); ok {
+		return err
+	}
+	if err != nil {
+		return errors.New("upload failed")
+	}
+
+	// a .git file would point go-git at another repository
+	gitDir := filepath.Join(hostedProjectPath, git.GitDirName)
+	fi, err := os.Lstat(gitDir)
+	if err != nil || !fi.IsDir() {
+		return errors.New("upload has no .git directory")
+	}
+	for _, name := range []string{"config", "hooks"} {
+		err = os.RemoveAll(filepath.Join(gitDir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func validRelativeDir(dir string) bool {
 	if strings.Contains(dir, `\`) || path.IsAbs(dir) {
 		return false
@@ -269,265 +805,384 @@ func validRelativeDir(dir string) bool {
 }
 
 func validRelPath(p string) bool {
-	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
+	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "\x00") {
 		return false
 	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
 	return true
 }
 
-// func liveListRequest() http.HandlerFunc {
-// 	return func(w http.ResponseWriter, r *http.Request) {
-// 		switch r.Method {
-// 		case "OPTIONS":
-// 			CORSforOptions(&w)
-// 			return
-// 		case "GET":
-// 			// requestBody, err := ioutil.ReadAll(r.Body)
-// 			// defer r.Body.Close()
-// 			// if err != nil {
-// 			// 	responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-// 			// 	return
-// 			// }
-
-// 			ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-// 			client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-// 			if err != nil {
-// 				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-// 				return
-// 			}
-// 			defer client.Disconnect(ctx)
-
-// 			liveCodingCollection := client.Database("liveCoding").Collection("commit")
-
-// 			pipeline := bson.A{
-// 				bson.D{{"$group", bson.D{{"_id", "$project_path"}}}},
-// 			}
-// 			cur, err := liveCodingCollection.Aggregate(ctx, pipeline)
-// 			if err != nil {
-// 				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-// 				return
-// 			}
-
-// 			projectsNameMap := []map[string]string{}
-
-// 			err = cur.All(ctx, &projectsNameMap)
-// 			if err != nil {
-// 				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-// 				return
-// 			}
-
-// 			projectsName := []string{}
-
-// 			for _, value := range projectsNameMap {
-// 				projectsName = append(projectsName, value["_id"])
-// 			}
-
-// 			// fmt.Println(projectsNameMap)
-
-// 			// fmt.Println(requestBody)
-
-// 			responseJSON(w, http.StatusOK, projectsName)
-// 		default:
-// 			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET method is supported.")
-// 			return
-// 		}
-// 	}
-// }
-
-func liveUploadRequest() http.HandlerFunc {
+// liveListRequest lists the recordings, newest first unless sort=length
+// or order=asc is given. name and lang filter the list.
+func liveListRequest(store Store, auth *authenticator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println(123)
 		switch r.Method {
 		case "OPTIONS":
 			CORSforOptions(&w)
 			return
-		case "POST":
-			// if r.Close == true {
-			// 	return
-			// }
-
+		case "GET":
 			queryKeys := r.URL.Query()
 
-			queryKey, ok := queryKeys["projectName"]
-
-			if !ok || len(queryKey[0]) < 1 {
-				responseErrorJSON(w, http.StatusInternalServerError, "url query 'projectName' is missing")
-				return
+			uploadQuery := UploadQuery{
+				Viewer: auth.user(r),
+				Name:   queryKeys.Get("name"),
+				Lang:   queryKeys.Get("lang"),
+				Sort:   queryKeys.Get("sort"),
+				Desc:   queryKeys.Get("order") != "asc",
 			}
-
-			projectName := queryKey[0]
-
-			if strings.Contains(projectName, "/") || strings.Contains(projectName, "\\") {
-				responseErrorJSON(w, http.StatusInternalServerError, "invalid projectName.")
+			if uploadQuery.Sort == "" {
+				uploadQuery.Sort = uploadSortDate
+			}
+			if uploadQuery.Sort != uploadSortDate && uploadQuery.Sort != uploadSortLength {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'sort' must be 'date' or 'length'")
 				return
 			}
 
-			// 10MB Limit
-			requestBody, err := ioutil.ReadAll(io.LimitReader(r.Body, 10000000))
-			defer r.Body.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err, liveUploads := store.FindUploads(ctx, uploadQuery)
 			if err != nil {
 				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
 				return
 			}
 
-			r := bytes.NewReader(requestBody)
-
-			if _, err := os.Stat(liveLogPath); os.IsNotExist(err) {
-				err = os.Mkdir(liveLogPath, 0775)
-				if err != nil {
-					responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-					return
-				}
+			liveListResponse := LiveListResponse{}
+			for _, liveUpload := range liveUploads {
+				liveListResponse = append(liveListResponse, LiveListItem{
+					ID:          liveUpload.AssignProjectName,
+					ProjectName: liveUpload.OriginalProjectName,
+					URL:         liveViewURL + liveUpload.AssignProjectName,
+					Status:      liveUpload.Status,
+					Owner:       liveUpload.Owner,
+					Visibility:  liveUpload.visibility(),
+					CreatedAt:   liveUpload.CreatedAt,
+					CommitCount: liveUpload.CommitCount,
+					Duration:    liveUpload.Duration,
+					Languages:   liveUpload.Languages,
+					Size:        liveUpload.Size,
+				})
 			}
 
-			absliveLogPath, err := filepath.Abs(liveLogPath)
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, "upload failed")
-				return
-			}
+			responseJSON(w, http.StatusOK, liveListResponse)
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET method is supported.")
+			return
+		}
+	}
+}
 
-			assignProjectNameLength := 20
-			assignProjectName := randomText(assignProjectNameLength)
+// uploadExpiry reads the ttl query in seconds, falling back to the
+// configured default. It returns the expiry time, 0 for none.
+func uploadExpiry(query url.Values, defaultTTL int64) (error, int64) {
+	ttl := defaultTTL
+	if value := query.Get("ttl"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("url query 'ttl' is invalid"), 0
+		}
+		ttl = n
+	}
+	if ttl == 0 {
+		return nil, 0
+	}
+	return nil, nowMillis() + ttl*1000
+}
 
-			hostedProjectPath := absliveLogPath + "/" + assignProjectName
-			err = os.Mkdir(hostedProjectPath, 0775)
-			if err != nil {
-				// os.RemoveAll(hostedProjectPath)
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+// uploadParams describes a recording to create, read from the url query of
+// an upload, or of the start of a chunked upload.
+type uploadParams struct {
+	Owner       string `json:"owner"`
+	ProjectName string `json:"projectName"`
+	Visibility  string `json:"visibility"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	Slug        string `json:"slug"`
+	GitURL      string `json:"url"`
+	Branch      string `json:"branch"`
+	Head        string `json:"head"`
+	ContentType string `json:"contentType"`
+}
 
-			// fileToWrite, err := os.OpenFile("./compress.tar.gzip", os.O_CREATE|os.O_RDWR, os.FileMode(0644))
-			// if err != nil {
-			// 	panic(err)
-			// }
-			// if _, err := io.Copy(fileToWrite, r); err != nil {
-			// 	panic(err)
-			// }
+func parseUploadParams(r *http.Request, auth *authenticator, options uploadOptions) (error, uploadParams) {
+	queryKeys := r.URL.Query()
 
-			prevDir, err := filepath.Abs(".")
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+	err, owner := auth.requireUser(r)
+	if err != nil {
+		return err, uploadParams{}
+	}
 
-			err = os.Chdir(hostedProjectPath)
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+	visibility := queryKeys.Get("visibility")
+	if visibility == "" {
+		visibility = visibilityPublic
+	}
+	err = validVisibility(visibility, owner)
+	if err != nil {
+		return err, uploadParams{}
+	}
 
-			err = untar(r, ".")
-			if err != nil {
-				// os.RemoveAll(hostedProjectPath)
-				responseErrorJSON(w, http.StatusInternalServerError, "upload failed")
-				return
-			}
+	err, expiresAt := uploadExpiry(queryKeys, options.ttl)
+	if err != nil {
+		return err, uploadParams{}
+	}
 
-			cmd := exec.Command("git", "stash")
-			err = cmd.Run()
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+	// with url the recording is cloned instead of read from the body
+	gitURL := queryKeys.Get("url")
+	if gitURL != "" {
+		err = validCloneURL(gitURL, options.clone, options.dir)
+		if err != nil {
+			return err, uploadParams{}
+		}
+	}
 
-			err = os.Chdir(prevDir)
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+	queryKey, ok := queryKeys["projectName"]
 
-			// hostedPath := hostedProjectPath + "/" + projectName
+	if (!ok || len(queryKey[0]) < 1) && gitURL == "" {
+		return errors.New("url query 'projectName' is missing"), uploadParams{}
+	}
 
-			ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-			client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			defer client.Disconnect(ctx)
+	var projectName string
+	if ok && len(queryKey[0]) > 0 {
+		projectName = queryKey[0]
+	} else {
+		projectName = cloneProjectName(gitURL)
+	}
 
-			liveUploadCollection := client.Database("liveCoding").Collection("upload")
+	if strings.Contains(projectName, "/") || strings.Contains(projectName, "\\") {
+		return errors.New("invalid projectName."), uploadParams{}
+	}
 
-			liveUpload := LiveUpload{
-				AssignProjectName:   assignProjectName,
-				OriginalProjectName: projectName,
-				HostedProjectPath:   hostedProjectPath,
-			}
+	return nil, uploadParams{
+		Owner:       owner,
+		ProjectName: projectName,
+		Visibility:  visibility,
+		ExpiresAt:   expiresAt,
+		Slug:        queryKeys.Get("slug"),
+		GitURL:      gitURL,
+		Branch:      queryKeys.Get("branch"),
+		Head:        queryKeys.Get("head"),
+		ContentType: r.Header.Get("Content-Type"),
+	}
+}
 
-			_, err = liveUploadCollection.InsertOne(ctx, liveUpload)
-			if err != nil {
-				// os.RemoveAll(hostedProjectPath)
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+// peekUploadFormat detects the format from the first bytes of the body
+// without consuming them.
+func peekUploadFormat(contentType string, body io.Reader) (error, string, io.Reader) {
+	br := bufio.NewReader(body)
+	head, err := br.Peek(32)
+	if err != nil && err != io.EOF {
+		return err, "", nil
+	}
+	return nil, detectUploadFormat(contentType, head), br
+}
 
-			// fmt.Println(hostedProjectPath)
-			gitRepo, err := git.PlainOpen(hostedProjectPath)
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+// createUpload stores the recording read from body, or cloned when the
+// params name a url, and returns its upload.
+func createUpload(store Store, params uploadParams, uploadFormat string, body io.Reader, options uploadOptions) (error, LiveUpload) {
+	if _, err := os.Stat(options.dir); os.IsNotExist(err) {
+		err = os.Mkdir(options.dir, 0775)
+		if err != nil {
+			return err, LiveUpload{}
+		}
+	}
 
-			cIter, err := gitRepo.Log(&git.LogOptions{All: false})
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+	absliveLogPath, err := filepath.Abs(options.dir)
+	if err != nil {
+		return errors.New("upload failed"), LiveUpload{}
+	}
 
-			var commitObjects []*object.Commit
-			err = cIter.ForEach(func(commitObj *object.Commit) error {
-				// fmt.Println(commitObj.Hash)
-				commitObjects = append(commitObjects, commitObj)
-				return nil
-			})
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+	err, assignProjectName, hostedProjectPath := reserveProjectName(store, absliveLogPath, params.Slug)
+	if err != nil {
+		return err, LiveUpload{}
+	}
 
-			for i, j := 0, len(commitObjects)-1; i < j; i, j = i+1, j-1 {
-				commitObjects[i], commitObjects[j] = commitObjects[j], commitObjects[i]
-			}
+	// the recording is built in a staging directory and only moved
+	// into livelog once it is complete; anything left behind by a
+	// failure is removed
+	stagingPath := filepath.Join(absliveLogPath, ".staging", assignProjectName)
+	committed := false
+	placed := false
+	defer func() {
+		if committed {
+			return
+		}
+		os.RemoveAll(stagingPath)
+		if placed {
+			os.RemoveAll(hostedProjectPath)
+		} else {
+			// only ever the empty directory reserved for the id
+			os.Remove(hostedProjectPath)
+		}
+		removeSnapshots(hostedProjectPath)
+	}()
 
-			commitCollection := client.Database("liveCoding").Collection("commit")
+	err = os.MkdirAll(stagingPath, 0775)
+	if err != nil {
+		return err, LiveUpload{}
+	}
 
-			for i := 0; i < len(commitObjects); i++ {
-				commitObject := commitObjects[i]
-				// fmt.Println(commitObject.Hash)
+	// fileToWrite, err := os.OpenFile("./compress.tar.gzip", os.O_CREATE|os.O_RDWR, os.FileMode(0644))
+	// if err != nil {
+	// 	panic(err)
+	// }
+	// if _, err := io.Copy(fileToWrite, r); err != nil {
+	// 	panic(err)
+	// }
+
+	switch uploadFormat {
+	case uploadFormatClone:
+		err = cloneGitUpload(stagingPath, params.GitURL, params.Branch, options.limits)
+	case uploadFormatBundle, uploadFormatPack:
+		err = importGitUpload(stagingPath, uploadFormat, body, params.Head, options.limits)
+	default:
+		err = extractTarball(body, stagingPath, options.limits)
+	}
+	if err != nil {
+		return err, LiveUpload{}
+	}
 
-				commitTime, err := strconv.ParseInt(commitObject.Message, 10, 64)
-				if err != nil {
-					commitTime = -1
-				}
-				commitStruct := Commit{
-					ProjectPath: hostedProjectPath,
-					ProjectName: projectName,
-					Hash:        commitObject.Hash.String(),
-					Time:        commitTime,
-					ID:          i,
-				}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	gitRepo, err := git.PlainOpen(stagingPath)
+	if err != nil {
+		return err, LiveUpload{}
+	}
+
+	cIter, err := gitRepo.Log(&git.LogOptions{All: false})
+	if err != nil {
+		return err, LiveUpload{}
+	}
+
+	var commitObjects []*object.Commit
+	err = cIter.ForEach(func(commitObj *object.Commit) error {
+		commitObjects = append(commitObjects, commitObj)
+		return nil
+	})
+	if err != nil {
+		return err, LiveUpload{}
+	}
+
+	for i, j := 0, len(commitObjects)-1; i < j; i, j = i+1, j-1 {
+		commitObjects[i], commitObjects[j] = commitObjects[j], commitObjects[i]
+	}
+
+	var commits Commits
+	for i := 0; i < len(commitObjects); i++ {
+		commitObject := commitObjects[i]
+
+		commits = append(commits, Commit{
+			ProjectPath: hostedProjectPath,
+			ProjectName: params.ProjectName,
+			Hash:        commitObject.Hash.String(),
+			Time:        commitTime(commitObject),
+			ID:          i,
+		})
+	}
+
+	err, manageKey := randomText(32)
+	if err != nil {
+		return err, LiveUpload{}
+	}
+
+	liveUpload := LiveUpload{
+		AssignProjectName:   assignProjectName,
+		OriginalProjectName: params.ProjectName,
+		HostedProjectPath:   hostedProjectPath,
+		CreatedAt:           nowMillis(),
+		Owner:               params.Owner,
+		Visibility:          params.Visibility,
+		ExpiresAt:           params.ExpiresAt,
+		ManageKey:           manageKey,
+	}
+	liveUpload.addCommits(commits)
+	if len(commits) > 0 {
+		err = liveUpload.describeHead(gitRepo, commits[len(commits)-1].Hash)
+		if err != nil {
+			return err, LiveUpload{}
+		}
+	}
+
+	// replaces the empty directory reserved for the id in one step, so
+	// the id is never free for another upload to take; os.Rename refuses
+	// to replace a directory
+	err = syscall.Rename(stagingPath, hostedProjectPath)
+	if err != nil {
+		return err, LiveUpload{}
+	}
+	placed = true
 
-				_, err = commitCollection.InsertOne(ctx, commitStruct)
+	err = store.CreateUpload(ctx, liveUpload, commits)
+	if err != nil {
+		return err, LiveUpload{}
+	}
+	committed = true
+
+	go warmSnapshots(hostedProjectPath, commits)
+
+	return nil, liveUpload
+}
+
+func liveUploadRequest(store Store, auth *authenticator, hub *sessionHub, options uploadOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "DELETE", "PATCH":
+			manageUpload(w, r, store, auth, hub)
+			return
+		case "POST":
+			// if r.Close == true {
+			// 	return
+			// }
+
+			err, params := parseUploadParams(r, auth, options)
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			// the body is extracted while it is read, never held in memory
+			var body io.Reader
+			var limited *limitedBody
+			uploadFormat := uploadFormatClone
+			if params.GitURL == "" {
+				defer r.Body.Close()
+				limited = newLimitedBody(r.Body, options.maxSize)
+				err, uploadFormat, body = peekUploadFormat(params.ContentType, limited)
 				if err != nil {
-					responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+					responseErrorJSON(w, errorStatus(err), err.Error())
 					return
 				}
+			}
 
-				// fmt.Println(requestBody, 111)
+			err, liveUpload := createUpload(store, params, uploadFormat, body, options)
+			if limited != nil && limited.tooLarge() {
+				err = limited.err()
+			}
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
 			}
 
-			liveUploadsResponse := LiveUploadsResponse{LiveUploadResponse{URL: "https://live-coding.takukitamura.com/?id=" + assignProjectName}}
+			liveUploadsResponse := LiveUploadsResponse{LiveUploadResponse{
+				URL: liveViewURL + liveUpload.AssignProjectName,
+				Key: liveUpload.ManageKey,
+			}}
 
 			responseJSON(w, http.StatusOK, liveUploadsResponse)
 		default:
-			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET method is supported.")
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only POST, PATCH and DELETE methods are supported.")
 			return
 		}
 	}
 }
 
-func liveRequest() http.HandlerFunc {
+func liveRequest(store Store, auth *authenticator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "OPTIONS":
@@ -549,6 +1204,12 @@ func liveRequest() http.HandlerFunc {
 
 			id := queryKey[0]
 
+			err, replayQuery := parseReplayQuery(r.URL.Query())
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
 			// requestBody, err := ioutil.ReadAll(r.Body)
 			// defer r.Body.Close()
 			// if err != nil {
@@ -568,210 +1229,38 @@ func liveRequest() http.HandlerFunc {
 			// 	return
 			// }
 
-			ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-			client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			defer client.Disconnect(ctx)
-
-			uploadCollection := client.Database("liveCoding").Collection("upload")
-
-			filter := bson.M{"assign_project_name": id}
-			result := uploadCollection.FindOne(ctx, filter)
-
-			liveUpload := LiveUpload{}
-			err = result.Decode(&liveUpload)
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			liveCodingCollection := client.Database("liveCoding").Collection("commit")
-
-			// fmt.Println(liveRequest.ProjectPath)
-			filter = bson.M{"project_path": liveUpload.HostedProjectPath}
-			cur, err := liveCodingCollection.Find(ctx, filter)
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			livesResponse := LivesResponse{}
-			err = cur.All(ctx, &livesResponse)
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			// fmt.Println(livesResponse)
-			// err = cur.All(ctx, &livesResponse)
-			// if err != nil {
-			// 	responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-			// 	return
-			// }
-
-			// fmt.Println(livesResponse)
-
-			// TODO: for の外に出す｡
-			// var repo *git.Repository
-			// if _, err := os.Stat(liveRequest.ProjectPath); os.IsNotExist(err) {
-			// 	repo, err = git.PlainInit(liveRequest.ProjectPath, false)
-			// 	if err != nil {
-			// 		responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-			// 		return
-			// 	}
-			// } else {
-			// 	repo, err = git.PlainOpen(liveRequest.ProjectPath)
-			// 	if err != nil {
-			// 		responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-			// 		return
-			// 	}
-			// }
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
 
-			var repo *git.Repository
-			repo, err = git.PlainOpen(liveUpload.HostedProjectPath)
+			err, liveUpload, livesResponse := findLiveCommits(ctx, store, id, auth.user(r), replayQuery)
 			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				responseErrorJSON(w, errorStatus(err), err.Error())
 				return
 			}
 
-			wt, err := repo.Worktree()
-			if err != nil {
-				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-				return
+			var nextCursor *int
+			if replayQuery.Limit > 0 && len(livesResponse) > replayQuery.Limit {
+				nextCursor = &livesResponse[replayQuery.Limit].ID
+				livesResponse = livesResponse[:replayQuery.Limit]
 			}
 
-			cmd := exec.Command("git", "stash")
-			cmd.Dir = wt.Filesystem.Root()
-			err = cmd.Run()
+			err, builder := newFrameBuilder(liveUpload, replayQuery.Format)
 			if err != nil {
-				// fmt.Println(err, 111)
 				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
 				return
 			}
 
 			for i := 0; i < len(livesResponse); i++ {
-				// fmt.Println(i)
-				liveResponse := livesResponse[i]
-
-				err = wt.Checkout(&git.CheckoutOptions{
-					Branch: plumbing.NewBranchReferenceName("master"),
-				})
+				err, livesResponse[i] = builder.build(livesResponse[i])
 				if err != nil {
-					// fmt.Println(err, 222)
 					responseErrorJSON(w, http.StatusInternalServerError, err.Error())
 					return
 				}
-
-				err = wt.Checkout(&git.CheckoutOptions{
-					Hash: plumbing.NewHash(liveResponse.Hash),
-				})
-				if err != nil {
-					// fmt.Println(err, 333)
-					responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-					return
-				}
-
-				fileInfos, err := ioutil.ReadDir(liveUpload.HostedProjectPath)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				absPaths := []string{}
-
-				for _, file := range fileInfos {
-					fileName := file.Name()
-					absPath := liveUpload.HostedProjectPath + "/" + fileName
-					if file.IsDir() {
-						if fileName == ".git" {
-							continue
-						}
-						err, tempPaths := dirwalk(absPath)
-						if err != nil {
-							log.Fatal(err)
-						}
-						absPaths = append(absPaths, tempPaths...)
-					} else {
-						absPaths = append(absPaths, absPath)
-					}
-				}
-
-				fileInfo := map[string]FileInfo{}
-
-				for j := 0; j < len(absPaths); j++ {
-					path := absPaths[j]
-
-					bytes, err := ioutil.ReadFile(path)
-					if err != nil {
-						responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-						return
-					}
-
-					code := string(bytes)
-					// fmt.Println(path, code, 1111)
-					fileInfoStruct := FileInfo{}
-					fileInfoStruct.Code = code
-					// fileInfo[path] = FileInfo{Code: code}
-					// fileInfo[path]
-
-					baseName := filepath.Base(path)
-
-					extention := filepath.Ext(baseName)
-
-					plaintext := "plaintext"
-
-					if baseName == ".cui.log" {
-						fileInfoStruct.Lang = "bash"
-					} else {
-
-						// ex a.py -> py
-						// extention := path[pos+1:]
-						if len(extention) == 0 {
-							fileInfoStruct.Lang = plaintext
-						} else {
-							if extention == ".py" {
-								fileInfoStruct.Lang = "python"
-							} else if extention == ".html" {
-								fileInfoStruct.Lang = "html"
-							} else if extention == ".js" {
-								fileInfoStruct.Lang = "javascript"
-							} else {
-								fileInfoStruct.Lang = plaintext
-							}
-						}
-					}
-
-					// fmt.Println(code)
-
-					err, commands := util.GetCommands(fileInfoStruct.Code, fileInfoStruct.Lang, baseName)
-					if err != nil {
-
-					}
-					// fmt.Println(baseName, code, commands, 777)
-
-					fileInfoStruct.Commands = commands
-
-					projectPath := strings.Replace(path, liveUpload.HostedProjectPath, liveUpload.OriginalProjectName, 1)
-
-					fileInfo[projectPath] = fileInfoStruct
-				}
-
-				err = wt.Checkout(&git.CheckoutOptions{
-					Branch: plumbing.NewBranchReferenceName("master"),
-				})
-				if err != nil {
-					// fmt.Println(err, 777)
-					responseErrorJSON(w, http.StatusInternalServerError, err.Error())
-					return
-				}
-
-				livesResponse[i].Files = fileInfo
 			}
 
-			for i := 0; i < len(livesResponse); i++ {
-				livesResponse[i].ProjectPath = ""
+			if replayQuery.Paged {
+				responseJSON(w, http.StatusOK, LivePageResponse{Frames: livesResponse, NextCursor: nextCursor})
+				return
 			}
 
 			// fmt.Println(livesResponse)
@@ -787,6 +1276,29 @@ func liveRequest() http.HandlerFunc {
 	}
 }
 
+func healthRequest(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "GET":
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err := store.Ping(ctx)
+			if err != nil {
+				responseErrorJSON(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			responseJSON(w, http.StatusOK, struct{}{})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET method is supported.")
+			return
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
@@ -826,26 +1338,91 @@ func main() {
 	}
 
 	apiEndpointName := "/api"
+	healthEndpointName := apiEndpointName + "/health"
 	liveEndpointName := apiEndpointName + "/live"
 	liveUploadEndpointName := liveEndpointName + "/upload"
-	// liveListEndpointName := apiEndpointName + "/liveList"
+	liveStreamEndpointName := liveEndpointName + "/stream"
+	liveSessionEndpointName := liveEndpointName + "/session"
+	liveSessionAppendEndpointName := liveSessionEndpointName + "/append"
+	liveSessionCloseEndpointName := liveSessionEndpointName + "/close"
+
+	err, store := newStore(config)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	err, auth := newAuthenticator(config.TokensPath)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 
-	http.HandleFunc(liveEndpointName, liveRequest())
-	http.HandleFunc(liveUploadEndpointName, liveUploadRequest())
-	// http.HandleFunc(liveListEndpointName, liveListRequesst())
+	if config.LanguagesPath != "" {
+		err = util.Languages.Load(config.LanguagesPath)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
 
-	// liveListEndpointName := apiEndpointName + "/liveList"
+	hub := newSessionHub()
+	liveListEndpointName := apiEndpointName + "/liveList"
+	liveChunkedUploadEndpointName := liveUploadEndpointName + "/chunked"
+	liveLintEndpointName := liveEndpointName + "/lint"
+	liveTimelineEndpointName := liveEndpointName + "/timeline"
+
+	options := config.uploadOptions()
+
+	http.HandleFunc(healthEndpointName, healthRequest(store))
+	http.HandleFunc(liveEndpointName, liveRequest(store, auth))
+	http.HandleFunc(liveUploadEndpointName, liveUploadRequest(store, auth, hub, options))
+	http.HandleFunc(liveStreamEndpointName, liveStreamRequest(store, auth, hub))
+	http.HandleFunc(liveSessionEndpointName, liveSessionRequest(store, auth, options))
+	http.HandleFunc(liveSessionAppendEndpointName, liveSessionAppendRequest(store, hub, options))
+	http.HandleFunc(liveSessionCloseEndpointName, liveSessionCloseRequest(store, hub))
+	http.HandleFunc(liveListEndpointName, liveListRequest(store, auth))
+	http.HandleFunc(liveChunkedUploadEndpointName, liveChunkedUploadRequest(store, auth, options))
+	http.HandleFunc(liveLintEndpointName, liveLintRequest(store, auth))
+	http.HandleFunc(liveTimelineEndpointName, liveTimelineRequest(store, auth))
 
 	schema := config.Schema
 	host := config.Host
 	port := config.Port
 	addr := host + ":" + port
+	server := &http.Server{Addr: addr}
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	go runJanitor(janitorCtx, store, hub, options)
+
+	// on SIGINT/SIGTERM let running requests finish, then close the store
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+		<-sigint
+		stopJanitor()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		err = store.Close(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		close(idleConnsClosed)
+	}()
+
 	fmt.Println("LISTEN: ", schema+"://"+addr)
-	err = http.ListenAndServe(addr, nil)
-	if err != nil {
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Println(err)
 		os.Exit(1)
 	}
+	<-idleConnsClosed
 	// 証明書の作成参考: https://ozuma.hatenablog.jp/entry/20130511/1368284304
 	/*
 		if envType == envTypeTest {
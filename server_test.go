@@ -1,12 +1,38 @@
 package main
 
 import (
-	"liveCoding/server/util"
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"liveCoding-api/util"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 func TestExampleSuccess(t *testing.T) {
-	err, commands := util.GetCommands("#@ \"content\": \"見出し1\"", "python")
+	err, commands := util.GetCommands("#@ \"content\": \"見出し1\"", "python", "a.py")
 	if err != nil {
 		t.Fatalf("failed test1 %s", err.Error())
 	}
@@ -15,7 +41,7 @@ func TestExampleSuccess(t *testing.T) {
 		t.Fatalf("failed test2")
 	}
 
-	err, commands = util.GetCommands("//@ \"content\": \"見出し1\"", "plaintext")
+	err, commands = util.GetCommands("//@ \"content\": \"見出し1\"", "plaintext", "a.txt")
 	if err != nil {
 		t.Fatalf("failed test3 %s", err.Error())
 	}
@@ -24,7 +50,7 @@ func TestExampleSuccess(t *testing.T) {
 		t.Fatalf("failed test4")
 	}
 
-	err, commands = util.GetCommands("//@ \"content\": \"見出し1\"", "plaintext")
+	err, commands = util.GetCommands("//@ \"content\": \"見出し1\"", "plaintext", "a.txt")
 	if err != nil {
 		t.Fatalf("failed test3 %s", err.Error())
 	}
@@ -33,3 +59,1391 @@ func TestExampleSuccess(t *testing.T) {
 		t.Fatalf("failed test4")
 	}
 }
+
+// recordingTarball builds the gzip-compressed tar a recording client
+// uploads: a project directory with a git repo of commits timed 1000ms
+// apart.
+func recordingTarball(t *testing.T, commitCount int) []byte {
+	var codes []string
+	code := ""
+	for i := 0; i < commitCount; i++ {
+		code += fmt.Sprintf("print(%d)\n", i)
+		codes = append(codes, code)
+	}
+	return recordingTarballOf(t, codes)
+}
+
+// recordingTarballOf records main.py with one commit per code.
+func recordingTarballOf(t *testing.T, codes []string) []byte {
+	projectPath, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectPath)
+
+	recordingRepo(t, projectPath, codes)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	err = filepath.Walk(projectPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == projectPath {
+			return err
+		}
+		rel, err := filepath.Rel(projectPath, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		err = tw.WriteHeader(header)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// recordingRepo commits main.py in projectPath once per code, 1000ms
+// apart.
+func recordingRepo(t *testing.T, projectPath string, codes []string) {
+	repo, err := git.PlainInit(projectPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, code := range codes {
+		err = ioutil.WriteFile(filepath.Join(projectPath, "main.py"), []byte(code), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wt.Add("main.py")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wt.Commit(fmt.Sprint(1000*(i+1)), &git.CommitOptions{
+			Author: &object.Signature{Name: "rec", Email: "rec@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testUploads gives a test its own recordings directory, so tests never
+// change the working directory and can run in parallel.
+func testUploads(t *testing.T, config Config) (*fileStore, uploadOptions) {
+	t.Helper()
+	options := config.uploadOptions()
+	options.dir = filepath.Join(t.TempDir(), liveLogPath)
+	// snapshots may still be warming when the test ends
+	t.Cleanup(func() {
+		snapshotMu.Lock()
+		defer snapshotMu.Unlock()
+		os.RemoveAll(options.dir)
+	})
+	return &fileStore{dir: filepath.Join(options.dir, ".store")}, options
+}
+
+func TestConcurrentUploadsAndReplays(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	prevDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := newSessionHub()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/live", liveRequest(store, auth))
+	mux.HandleFunc("/api/live/upload", liveUploadRequest(store, auth, hub, options))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	const commitCount = 5
+	tarball := recordingTarball(t, commitCount)
+
+	const uploads = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, uploads)
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- uploadAndReplay(server.URL, fmt.Sprintf("project%d", i), tarball, commitCount)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cwd != prevDir {
+		t.Fatalf("working directory changed to %s", cwd)
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{MaxUploadSize: 1000})
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/live", liveRequest(store, auth))
+	mux.HandleFunc("/api/live/upload", liveUploadRequest(store, auth, newSessionHub(), options))
+	mux.HandleFunc("/api/live/upload/chunked", liveChunkedUploadRequest(store, auth, options))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	const commitCount = 3
+	tarball := recordingTarball(t, commitCount)
+	if int64(len(tarball)) <= options.maxSize {
+		t.Fatalf("tarball of %d bytes fits in one request", len(tarball))
+	}
+
+	// too large for one request
+	res, err := http.Post(server.URL+"/api/live/upload?projectName=big", "application/gzip", bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload status %d, want 413", res.StatusCode)
+	}
+
+	call := func(method string, query string, body []byte) ChunkedUploadResponse {
+		req, err := http.NewRequest(method, server.URL+"/api/live/upload/chunked?"+query, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			data, _ := ioutil.ReadAll(res.Body)
+			t.Fatalf("%s %s: %d %s", method, query, res.StatusCode, data)
+		}
+		chunkedUploadsResponse := ChunkedUploadsResponse{}
+		err = json.NewDecoder(res.Body).Decode(&chunkedUploadsResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chunkedUploadsResponse[0]
+	}
+
+	started := call("POST", "projectName=chunked", nil)
+	uploadID := started.UploadID
+	var parts [][]byte
+	for rest := tarball; len(rest) > 0; {
+		n := int(started.PartSize)
+		if n > len(rest) {
+			n = len(rest)
+		}
+		parts = append(parts, rest[:n])
+		rest = rest[n:]
+	}
+	// part 1 is sent twice, as after a dropped connection
+	for i := len(parts) - 1; i >= 0; i-- {
+		call("PUT", fmt.Sprintf("uploadId=%s&part=%d", uploadID, i), parts[i])
+	}
+	status := call("PUT", fmt.Sprintf("uploadId=%s&part=1", uploadID), parts[1])
+	if len(status.Parts) != len(parts) {
+		t.Fatalf("%d parts received, want %d", len(status.Parts), len(parts))
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/live/upload/chunked?uploadId=%s&parts=%d", server.URL, uploadID, len(parts)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("complete: %d %s", res.StatusCode, data)
+	}
+	liveUploadsResponse := LiveUploadsResponse{}
+	err = json.NewDecoder(res.Body).Decode(&liveUploadsResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimPrefix(liveUploadsResponse[0].URL, liveViewURL)
+
+	err, commits := store.FindCommits(context.Background(), filepath.Join(options.dir, id), ReplayQuery{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != commitCount {
+		t.Fatalf("%d commits stored, want %d", len(commits), commitCount)
+	}
+	if _, err := os.Stat(chunkedUploadPath(options.dir, uploadID)); !os.IsNotExist(err) {
+		t.Fatalf("parts are kept after completing: %v", err)
+	}
+}
+
+func uploadAndReplay(serverURL string, projectName string, tarball []byte, commitCount int) error {
+	res, err := http.Post(serverURL+"/api/live/upload?projectName="+projectName, "application/gzip", bytes.NewReader(tarball))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("upload %s: %d %s", projectName, res.StatusCode, body)
+	}
+
+	liveUploadsResponse := LiveUploadsResponse{}
+	err = json.NewDecoder(res.Body).Decode(&liveUploadsResponse)
+	if err != nil {
+		return err
+	}
+	id := strings.TrimPrefix(liveUploadsResponse[0].URL, liveViewURL)
+
+	res, err = http.Post(serverURL+"/api/live?format=full&id="+id, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("replay %s: %d %s", projectName, res.StatusCode, body)
+	}
+
+	livesResponse := LivesResponse{}
+	err = json.NewDecoder(res.Body).Decode(&livesResponse)
+	if err != nil {
+		return err
+	}
+	if len(livesResponse) != commitCount {
+		return fmt.Errorf("replay %s: %d frames, want %d", projectName, len(livesResponse), commitCount)
+	}
+	for i, liveResponse := range livesResponse {
+		fileInfo, ok := liveResponse.Files[projectName+"/main.py"]
+		if !ok {
+			return fmt.Errorf("replay %s: frame %d misses main.py", projectName, i)
+		}
+		if want := fmt.Sprintf("print(%d)\n", i); !strings.HasSuffix(fileInfo.Code, want) {
+			return fmt.Errorf("replay %s: frame %d is %q", projectName, i, fileInfo.Code)
+		}
+		if liveResponse.Time != int64(1000*(i+1)) {
+			return fmt.Errorf("replay %s: frame %d has time %d", projectName, i, liveResponse.Time)
+		}
+	}
+	return nil
+}
+
+type tarEntry struct {
+	header tar.Header
+	body   string
+}
+
+func tarGz(entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.body))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		tw.WriteHeader(&header)
+		tw.Write([]byte(entry.body))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestUntarPolicy(t *testing.T) {
+	limits := ExtractLimits{MaxFiles: 4, MaxTotalSize: 10, MaxDepth: 3, MaxFileSize: 6}
+	file := func(name string, body string) tarEntry {
+		return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeReg}, body}
+	}
+	link := func(name string, target string) tarEntry {
+		return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}, ""}
+	}
+
+	tests := []struct {
+		name     string
+		entries  []tarEntry
+		ok       bool
+		tooLarge bool
+	}{
+		{"files", []tarEntry{file("a.py", "a"), file("src/b.py", "b")}, true, false},
+		{"link inside", []tarEntry{file("src/b.py", "b"), link("src/c.py", "b.py"), link("d", "src")}, true, false},
+		{"link up inside", []tarEntry{file("a.py", "a"), link("src/a.py", "../a.py")}, true, false},
+		{"absolute link", []tarEntry{link("a", "/etc/passwd")}, false, false},
+		{"link outside", []tarEntry{link("src/a", "../../a")}, false, false},
+		{"climb behind link", []tarEntry{link("a", "."), link("b", "a/../x")}, false, false},
+		{"write through link", []tarEntry{link("a", "src"), file("a/b.py", "b")}, false, false},
+		{"replace link", []tarEntry{file("b.py", "b"), link("a", "b.py"), file("a", "x")}, false, false},
+		{"parent name", []tarEntry{file("../a", "a")}, false, false},
+		{"dot dot", []tarEntry{{tar.Header{Name: "..", Typeflag: tar.TypeDir, Mode: 0755}, ""}}, false, false},
+		{"hard link", []tarEntry{file("a", "a"), {tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}, ""}}, false, false},
+		{"too many files", []tarEntry{file("a", ""), file("b", ""), file("c", ""), file("d", ""), file("e", "")}, false, true},
+		{"too deep", []tarEntry{file("a/b/c/d", "")}, false, true},
+		{"file too large", []tarEntry{file("a", "1234567")}, false, true},
+		{"total too large", []tarEntry{file("a", "123456"), file("b", "123456")}, false, true},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "untar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = untar(bytes.NewReader(tarGz(test.entries)), filepath.Join(dir, "project"), limits)
+		os.RemoveAll(dir)
+		if test.ok != (err == nil) {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+		if _, tooLarge := err.(tooLargeError); tooLarge != test.tooLarge {
+			t.Errorf("%s: err = %v, want too large %v", test.name, err, test.tooLarge)
+		}
+	}
+}
+
+func TestExtractTarballDropsGitConfig(t *testing.T) {
+	file := func(name string, body string) tarEntry {
+		return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0755}, body}
+	}
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	projectPath := filepath.Join(dir, "project")
+	err = extractTarball(bytes.NewReader(tarGz([]tarEntry{
+		file(".git/HEAD", "ref: refs/heads/master\n"),
+		file(".git/config", "[core]\n\tfsmonitor = touch pwned\n"),
+		file(".git/hooks/post-checkout", "#!/bin/sh\ntouch pwned\n"),
+		file("main.py", "print(1)\n"),
+	})), projectPath, ExtractLimits{}.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".git/config", ".git/hooks", "pwned"} {
+		if _, err := os.Lstat(filepath.Join(projectPath, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is kept: %v", name, err)
+		}
+	}
+
+	err = extractTarball(bytes.NewReader(tarGz([]tarEntry{
+		file(".git", "gitdir: /srv/livelog/other/.git\n"),
+	})), filepath.Join(dir, "gitfile"), ExtractLimits{}.withDefaults())
+	if err == nil {
+		t.Fatal("a .git file was accepted")
+	}
+}
+
+// packObject encodes one object of a pack: its type and size, for a ref
+// delta the base hash, then the zlib-compressed data.
+func packObject(t *testing.T, objectType byte, data []byte, base []byte) []byte {
+	size := len(data)
+	header := []byte{objectType<<4 | byte(size&0xf)}
+	size >>= 4
+	for size > 0 {
+		header[len(header)-1] |= 0x80
+		header = append(header, byte(size&0x7f))
+		size >>= 7
+	}
+	var buf bytes.Buffer
+	buf.Write(header)
+	buf.Write(base)
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckPack(t *testing.T) {
+	const blob, refDelta = 3, 7
+	pack := func(objects ...[]byte) []byte {
+		buf := bytes.NewBufferString("PACK")
+		binary.Write(buf, binary.BigEndian, uint32(2))
+		binary.Write(buf, binary.BigEndian, uint32(len(objects)))
+		for _, object := range objects {
+			buf.Write(object)
+		}
+		return buf.Bytes()
+	}
+	base := packObject(t, blob, []byte("hello"), nil)
+	baseHash := plumbing.ComputeHash(plumbing.BlobObject, []byte("hello"))
+	// a few bytes claiming to build an object of 1GB
+	bomb := packObject(t, refDelta, []byte{0x05, 0x80, 0x80, 0x80, 0x80, 0x04, 0x91, 0x00, 0x05}, baseHash[:])
+
+	limits := ExtractLimits{MaxTotalSize: 1000000}.withDefaults()
+	if err := checkPack(bytes.NewReader(pack(base)), limits); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPack(bytes.NewReader(pack(base, bomb)), limits); errorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatalf("delta bomb gave %v", err)
+	}
+	if err := checkPack(bytes.NewReader(pack(base, base)), ExtractLimits{MaxObjects: 1}.withDefaults()); errorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatalf("too many objects gave %v", err)
+	}
+	large := packObject(t, blob, make([]byte, 2000000), nil)
+	if err := checkPack(bytes.NewReader(pack(large)), limits); errorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large object gave %v", err)
+	}
+}
+
+func TestImportPack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := filepath.Join(dir, "source")
+	recordingRepo(t, sourcePath, []string{"print(0)\n", "print(0)\nprint(1)\n"})
+	source, err := git.PlainOpen(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := source.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := source.Storer.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []plumbing.Hash
+	err = objects.ForEach(func(object plumbing.EncodedObject) error {
+		hashes = append(hashes, object.Hash())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pack bytes.Buffer
+	_, err = packfile.NewEncoder(&pack, source.Storer, false).Encode(hashes, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = importGitUpload(filepath.Join(dir, "small"), uploadFormatPack, bytes.NewReader(pack.Bytes()), head.Hash().String(), ExtractLimits{MaxObjects: 2}.withDefaults())
+	if errorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatalf("pack over the quota gave %v", err)
+	}
+	err = importGitUpload(filepath.Join(dir, "hosted"), uploadFormatPack, bytes.NewReader(pack.Bytes()), head.Hash().String(), ExtractLimits{}.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func FuzzValidRelPath(f *testing.F) {
+	for _, p := range []string{"a.py", "src/a.py", "../a", "a/../../b", "/etc", "a\\b", "..", "a/.."} {
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, p string) {
+		if !validRelPath(p) {
+			return
+		}
+		dir := filepath.FromSlash("/project")
+		abs := filepath.Join(dir, filepath.FromSlash(p))
+		if abs != dir && !strings.HasPrefix(abs, dir+string(filepath.Separator)) {
+			t.Fatalf("%q is valid but joins to %s", p, abs)
+		}
+	})
+}
+
+// FuzzUntar extracts arbitrary tarballs next to a sentinel directory and
+// fails when anything shows up outside the project.
+func FuzzUntar(f *testing.F) {
+	f.Add(tarGz([]tarEntry{
+		{tar.Header{Name: "src/a.py", Typeflag: tar.TypeReg}, "print(1)\n"},
+		{tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "src"}, ""},
+	}))
+	f.Add(tarGz([]tarEntry{
+		{tar.Header{Name: "../a", Typeflag: tar.TypeReg}, "a"},
+		{tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: ".."}, ""},
+		{tar.Header{Name: "up/a", Typeflag: tar.TypeReg}, "a"},
+	}))
+	limits := ExtractLimits{MaxFiles: 100, MaxTotalSize: 100000, MaxDepth: 8, MaxFileSize: 10000}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir, err := ioutil.TempDir("", "untar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		untar(bytes.NewReader(data), filepath.Join(dir, "project"), limits)
+
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range fis {
+			if fi.Name() != "project" {
+				t.Fatalf("untar wrote %s outside the project", fi.Name())
+			}
+		}
+	})
+}
+
+func TestLintFiles(t *testing.T) {
+	snapshot := map[string]FileInfo{}
+	for name, code := range map[string]string{
+		"main.py":    "#@ \"focus\": \"lib.py\"\n#@ \"shout\": \"hi\"\nprint(1)\n",
+		"lib.py":     "#@ \"focus\": \"missing.py\"\n",
+		"index.html": "<!--@ \"heading\": \"ok\" -->\n",
+	} {
+		lang := util.Languages.Detect(name, code).Lang
+		_, annotations, annotationErrors := util.ParseAnnotations(code, lang, name)
+		snapshot[name] = FileInfo{Code: code, Lang: lang, Annotations: annotations, AnnotationErrors: annotationErrors}
+	}
+
+	warnings := lintFiles("abc", snapshot, "demo")
+	if len(warnings) != 2 {
+		t.Fatalf("got %+v", warnings)
+	}
+	if w := warnings[0]; w.File != "demo/lib.py" || w.Line != 1 || w.Hash != "abc" {
+		t.Fatalf("got %+v", w)
+	}
+	if w := warnings[1]; w.File != "demo/main.py" || w.Line != 2 {
+		t.Fatalf("got %+v", w)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball := recordingTarballOf(t, []string{
+		"#@ \"content\": \"Setup\"\nimport os\n",
+		"#@ \"content\": \"Setup\"\nimport os\n#@ \"chapter\": \"Loop\"\n",
+		"#@ \"content\": \"Setup\"\nimport os\n#@ \"chapter\": \"Loop\"\n#@ \"content\": \"Done\"\n",
+	})
+	err, liveUpload := createUpload(store, uploadParams{ProjectName: "demo", Visibility: visibilityPublic}, uploadFormatTarball, bytes.NewReader(tarball), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := liveUpload.AssignProjectName
+
+	server := httptest.NewServer(liveTimelineRequest(store, auth))
+	defer server.Close()
+	res, err := http.Get(server.URL + "?id=" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("timeline: %d %s", res.StatusCode, body)
+	}
+	timelinesResponse := TimelinesResponse{}
+	err = json.NewDecoder(res.Body).Decode(&timelinesResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chapters := timelinesResponse[0].Chapters
+	want := []Chapter{
+		{Title: "Setup", Kind: util.AnnotationHeading, ID: 0, Time: 1000, File: "demo/main.py", Line: 1},
+		{Title: "Loop", Kind: util.AnnotationChapter, ID: 1, Time: 2000, File: "demo/main.py", Line: 3},
+		{Title: "Done", Kind: util.AnnotationHeading, ID: 2, Time: 3000, File: "demo/main.py", Line: 4},
+	}
+	if len(chapters) != len(want) {
+		t.Fatalf("got %+v", chapters)
+	}
+	for i := range want {
+		want[i].Hash = chapters[i].Hash
+		if chapters[i] != want[i] || chapters[i].Hash == "" {
+			t.Fatalf("chapter %d is %+v, want %+v", i, chapters[i], want[i])
+		}
+	}
+}
+
+func TestCloneFileURL(t *testing.T) {
+	// the file transport runs git-upload-pack
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Parallel()
+
+	store, options := testUploads(t, Config{})
+	workDir := filepath.Dir(options.dir)
+	sourceRoot := filepath.Join(workDir, "src")
+	sourcePath := filepath.Join(sourceRoot, "demo")
+	err := os.MkdirAll(sourcePath, 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordingRepo(t, sourcePath, []string{"print(0)\n", "print(0)\nprint(1)\n"})
+	gitURL := "file://" + sourcePath
+
+	if err = validCloneURL(gitURL, CloneConfig{}.withDefaults(), options.dir); err == nil {
+		t.Fatal("file url cloned without a root")
+	}
+	if err = validCloneURL("http://127.0.0.1/repo.git", CloneConfig{}.withDefaults(), options.dir); err == nil {
+		t.Fatal("http url cloned without being allowed")
+	}
+	config := CloneConfig{FileRoots: []string{workDir}}.withDefaults()
+	if err = validCloneURL("file://"+filepath.Join(workDir, "src", "..", ".."), config, options.dir); err == nil {
+		t.Fatal("file url outside the root cloned")
+	}
+	err = os.MkdirAll(filepath.Join(options.dir, "recording"), 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = validCloneURL("file://"+filepath.Join(options.dir, "recording"), config, options.dir); err != errForbidden {
+		t.Fatalf("hosted recording clone gave %v", err)
+	}
+	if err = validCloneURL(gitURL, config, options.dir); err != nil {
+		t.Fatal(err)
+	}
+
+	params := uploadParams{ProjectName: "demo", Visibility: visibilityPublic, GitURL: gitURL}
+	err, liveUpload := createUpload(store, params, uploadFormatClone, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, liveUpload = store.FindUpload(context.Background(), liveUpload.AssignProjectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if liveUpload.CommitCount != 2 {
+		t.Fatalf("cloned %d commits, want 2", liveUpload.CommitCount)
+	}
+
+	options.limits = ExtractLimits{MaxTotalSize: 100}.withDefaults()
+	err, _ = createUpload(store, params, uploadFormatClone, nil, options)
+	if errorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatalf("clone over the quota gave %v", err)
+	}
+}
+
+func TestManageUploadKey(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(liveUploadRequest(store, auth, newSessionHub(), options))
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"?projectName=demo", "application/gzip", bytes.NewReader(recordingTarball(t, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	liveUploadsResponse := LiveUploadsResponse{}
+	err = json.NewDecoder(res.Body).Decode(&liveUploadsResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimPrefix(liveUploadsResponse[0].URL, liveViewURL)
+	key := liveUploadsResponse[0].Key
+	if key == "" {
+		t.Fatal("upload returned no manage key")
+	}
+
+	call := func(method string, query string) int {
+		req, err := http.NewRequest(method, server.URL+"?id="+id+query, strings.NewReader(`{"projectName": "renamed"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for _, query := range []string{"", "&key=wrong"} {
+		for _, method := range []string{"DELETE", "PATCH"} {
+			if status := call(method, query); status != http.StatusForbidden {
+				t.Fatalf("%s with %q gave %d", method, query, status)
+			}
+		}
+	}
+	err, liveUpload := store.FindUpload(context.Background(), id)
+	if err != nil || liveUpload.OriginalProjectName != "demo" {
+		t.Fatalf("unauthorized request changed the upload: %v %+v", err, liveUpload)
+	}
+
+	if status := call("DELETE", "&key="+key); status != http.StatusOK {
+		t.Fatalf("DELETE with the key gave %d", status)
+	}
+	if status := call("DELETE", "&key="+key); status != http.StatusNotFound {
+		t.Fatalf("DELETE of a deleted upload gave %d", status)
+	}
+	if err, _ = store.FindUpload(context.Background(), id); err != errNotFound {
+		t.Fatalf("deleted upload is still found: %v", err)
+	}
+}
+
+func TestConcurrentUploadsSameSlug(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	tarball := recordingTarball(t, 3)
+
+	const uploads = 8
+	var wg sync.WaitGroup
+	created := make(chan LiveUpload, uploads)
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := uploadParams{ProjectName: "demo", Visibility: visibilityPublic, Slug: "same-slug"}
+			err, liveUpload := createUpload(store, params, uploadFormatTarball, bytes.NewReader(tarball), options)
+			if err == nil {
+				created <- liveUpload
+			} else if err != errDuplicate {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(created)
+
+	if len(created) != 1 {
+		t.Fatalf("%d uploads took the slug, want 1", len(created))
+	}
+	liveUpload := <-created
+	_, err := git.PlainOpen(liveUpload.HostedProjectPath)
+	if err != nil {
+		t.Fatalf("recording was removed by a failed upload: %v", err)
+	}
+}
+
+func TestChunkedUploadQuota(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{MaxUploadSize: 100, MaxChunkedUploadSize: 250})
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(liveChunkedUploadRequest(store, auth, options))
+	defer server.Close()
+
+	call := func(method string, query string, size int) (int, ChunkedUploadResponse) {
+		req, err := http.NewRequest(method, server.URL+"?"+query, bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		chunkedUploadsResponse := ChunkedUploadsResponse{}
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&chunkedUploadsResponse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res.StatusCode, chunkedUploadsResponse[0]
+		}
+		return res.StatusCode, ChunkedUploadResponse{}
+	}
+
+	_, started := call("POST", "projectName=demo", 0)
+	uploadID := started.UploadID
+
+	steps := []struct {
+		part   int
+		size   int
+		status int
+	}{
+		{3, 10, http.StatusRequestEntityTooLarge},
+		{0, 100, http.StatusOK},
+		{1, 100, http.StatusOK},
+		{2, 100, http.StatusRequestEntityTooLarge},
+		{2, 50, http.StatusOK},
+		// a part sent again replaces the first attempt
+		{0, 100, http.StatusOK},
+		{1, 101, http.StatusRequestEntityTooLarge},
+	}
+	for _, step := range steps {
+		status, _ := call("PUT", fmt.Sprintf("uploadId=%s&part=%d", uploadID, step.part), step.size)
+		if status != step.status {
+			t.Fatalf("part %d of %d bytes: status %d, want %d", step.part, step.size, status, step.status)
+		}
+	}
+
+	_, received := call("GET", "uploadId="+uploadID, 0)
+	var total int64
+	for _, part := range received.Parts {
+		total += part.Size
+	}
+	if total != 250 {
+		t.Fatalf("%d bytes of parts stored, want 250", total)
+	}
+}
+
+func TestDiffFramesOmitEmptyFields(t *testing.T) {
+	prev := map[string]FileInfo{
+		"a.py": {Code: "print(1)\n", Lang: "python", Annotations: []util.Annotation{}},
+		"b.py": {Code: "print(2)\n", Lang: "python"},
+	}
+	next := map[string]FileInfo{
+		"a.py": {Code: "print(1)\nprint(3)\n", Lang: "python", Commands: util.Commands{Content: "Intro"}},
+	}
+	liveResponse := LiveResponse{Patches: diffFiles(prev, next)}
+	data, err := json.Marshal(liveResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var frame map[string]json.RawMessage
+	err = json.Unmarshal(data, &frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := frame["files"]; ok {
+		t.Fatalf("diff frame carries files: %s", data)
+	}
+	var patches map[string]map[string]json.RawMessage
+	err = json.Unmarshal(frame["patches"], &patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"commands", "annotations", "code", "hunks"} {
+		if _, ok := patches["b.py"][key]; ok {
+			t.Fatalf("removed file carries %s: %s", key, frame["patches"])
+		}
+	}
+	if string(patches["a.py"]["commands"]) != `{"content":"Intro"}` {
+		t.Fatalf("changed file carries commands %s", patches["a.py"]["commands"])
+	}
+}
+
+// failingInsertStore refuses every new upload.
+type failingInsertStore struct {
+	*fileStore
+}
+
+func (s failingInsertStore) InsertUpload(ctx context.Context, liveUpload LiveUpload) error {
+	return errors.New("insert failed")
+}
+
+func TestSessionFailureFreesID(t *testing.T) {
+	t.Parallel()
+	fileStore, options := testUploads(t, Config{})
+	store := failingInsertStore{fileStore}
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(liveSessionRequest(store, auth, options))
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"?projectName=demo&slug=my-session", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("session status %d, want 500", res.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(options.dir, "my-session")); !os.IsNotExist(err) {
+		t.Fatalf("failed session keeps its directory: %v", err)
+	}
+}
+
+func TestSessionLocksAreSeparate(t *testing.T) {
+	hub := newSessionHub()
+	unlock := hub.lock("a")
+
+	done := make(chan bool)
+	go func() {
+		hub.lock("b")()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session b waits for session a")
+	}
+
+	go func() {
+		hub.lock("a")()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("session a was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-done
+
+	if len(hub.locks) != 0 {
+		t.Fatalf("%d locks are kept", len(hub.locks))
+	}
+}
+
+// readEvent reads the next Server-Sent Event of a stream.
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// readFrameID reads the next event, which must be a frame, and returns
+// its commit ID.
+func readFrameID(t *testing.T, r *bufio.Reader) int {
+	t.Helper()
+	event, data := readEvent(t, r)
+	if event != "frame" {
+		t.Fatalf("got %s event %s, want a frame", event, data)
+	}
+	liveResponse := LiveResponse{}
+	err := json.Unmarshal([]byte(data), &liveResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return liveResponse.ID
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := uploadParams{ProjectName: "demo", Visibility: visibilityPublic}
+	err, liveUpload := createUpload(store, params, uploadFormatTarball, bytes.NewReader(recordingTarball(t, 5)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := liveUpload.AssignProjectName
+
+	hub := newSessionHub()
+	server := httptest.NewServer(liveStreamRequest(store, auth, hub))
+	defer server.Close()
+
+	stream := func(query string) (*http.Response, *bufio.Reader) {
+		res, err := http.Get(server.URL + "?id=" + id + "&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			t.Fatalf("%s: status %d", query, res.StatusCode)
+		}
+		return res, bufio.NewReader(res.Body)
+	}
+
+	tests := []struct {
+		query string
+		ids   []int
+	}{
+		{"", []int{0, 1, 2, 3, 4}},
+		{"limit=2", []int{0, 1}},
+		{"cursor=3", []int{3, 4}},
+		{"cursor=1&limit=2", []int{1, 2}},
+		// a recording that is not live ends with its last frame
+		{"follow=1&limit=2", []int{0, 1}},
+	}
+	for _, test := range tests {
+		res, r := stream(test.query)
+		for _, want := range test.ids {
+			if got := readFrameID(t, r); got != want {
+				t.Fatalf("%q: frame %d, want %d", test.query, got, want)
+			}
+		}
+		if event, data := readEvent(t, r); event != "end" {
+			t.Fatalf("%q: got %s event %s, want end", test.query, event, data)
+		}
+		res.Body.Close()
+	}
+
+	err, liveUpload = store.FindUpload(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveUpload.Status = uploadStatusLive
+	err = store.UpdateUpload(context.Background(), liveUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, commits := store.FindCommits(context.Background(), liveUpload.HostedProjectPath, ReplayQuery{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a followed page goes on with the stored commits after it, then
+	// with the appended ones
+	res, r := stream("follow=1&limit=2")
+	defer res.Body.Close()
+	for want := 0; want < len(commits); want++ {
+		if got := readFrameID(t, r); got != want {
+			t.Fatalf("followed frame %d, want %d", got, want)
+		}
+	}
+	last := commits[len(commits)-1]
+	hub.publish(id, last)
+	appended := last
+	appended.ID++
+	appended.Time += 1000
+	hub.publish(id, appended)
+	if got := readFrameID(t, r); got != appended.ID {
+		t.Fatalf("appended frame %d, want %d", got, appended.ID)
+	}
+	hub.close(id)
+	if event, data := readEvent(t, r); event != "end" {
+		t.Fatalf("closed session: got %s event %s, want end", event, data)
+	}
+}
+
+func TestReplayPages(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := uploadParams{ProjectName: "demo", Visibility: visibilityPublic}
+	err, liveUpload := createUpload(store, params, uploadFormatTarball, bytes.NewReader(recordingTarball(t, 5)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(liveRequest(store, auth))
+	defer server.Close()
+
+	page := func(query string) LivePageResponse {
+		res, err := http.Post(server.URL+"?id="+liveUpload.AssignProjectName+"&"+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(res.Body)
+			t.Fatalf("%s: %d %s", query, res.StatusCode, body)
+		}
+		livePageResponse := LivePageResponse{}
+		err = json.NewDecoder(res.Body).Decode(&livePageResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return livePageResponse
+	}
+
+	cursor := func(n int) *int {
+		return &n
+	}
+	tests := []struct {
+		query      string
+		ids        []int
+		nextCursor *int
+	}{
+		{"limit=2", []int{0, 1}, cursor(2)},
+		{"cursor=2&limit=2", []int{2, 3}, cursor(4)},
+		{"cursor=4&limit=2", []int{4}, nil},
+		// a page ending on the last commit has no next page
+		{"limit=5", []int{0, 1, 2, 3, 4}, nil},
+		{"cursor=5", []int{}, nil},
+		// commit times are 1000ms apart, starting at 1000
+		{"from=2000&to=3000", []int{1, 2}, nil},
+		{"from=2000&limit=1", []int{1}, cursor(2)},
+	}
+	for _, test := range tests {
+		livePageResponse := page(test.query)
+		var ids []int
+		for _, frame := range livePageResponse.Frames {
+			ids = append(ids, frame.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+			t.Fatalf("%s: frames %v, want %v", test.query, ids, test.ids)
+		}
+		next := livePageResponse.NextCursor
+		if (next == nil) != (test.nextCursor == nil) || next != nil && *next != *test.nextCursor {
+			t.Fatalf("%s: next cursor %v, want %v", test.query, next, test.nextCursor)
+		}
+		// every page starts from a full snapshot
+		if len(ids) > 0 && len(livePageResponse.Frames[0].Files) == 0 {
+			t.Fatalf("%s: first frame has no files", test.query)
+		}
+	}
+}
+
+func TestLiveList(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	err, auth := newAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, upload := range []struct {
+		projectName string
+		commitCount int
+	}{
+		{"Alpha", 2},
+		{"alphabet", 4},
+		{"Beta", 3},
+	} {
+		params := uploadParams{ProjectName: upload.projectName, Visibility: visibilityPublic}
+		err, _ := createUpload(store, params, uploadFormatTarball, bytes.NewReader(recordingTarball(t, upload.commitCount)), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(liveListRequest(store, auth))
+	defer server.Close()
+
+	tests := []struct {
+		query string
+		names []string
+	}{
+		{"sort=length", []string{"alphabet", "Beta", "Alpha"}},
+		{"sort=length&order=asc", []string{"Alpha", "Beta", "alphabet"}},
+		// name matches part of the project name, ignoring case
+		{"sort=length&name=ALPHA", []string{"alphabet", "Alpha"}},
+		{"sort=length&name=bet", []string{"alphabet", "Beta"}},
+		{"name=gamma", []string{}},
+		{"sort=length&lang=python", []string{"alphabet", "Beta", "Alpha"}},
+		{"lang=go", []string{}},
+	}
+	for _, test := range tests {
+		res, err := http.Get(server.URL + "?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		liveListResponse := LiveListResponse{}
+		err = json.NewDecoder(res.Body).Decode(&liveListResponse)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, item := range liveListResponse {
+			names = append(names, item.ProjectName)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(test.names) {
+			t.Fatalf("%s: listed %v, want %v", test.query, names, test.names)
+		}
+	}
+
+	res, err := http.Get(server.URL + "?sort=size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unknown sort gave %d", res.StatusCode)
+	}
+}
+
+func TestReserveProjectName(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	err := os.MkdirAll(options.dir, 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idPattern := regexp.MustCompile(fmt.Sprintf(`^[0-9A-Za-z]{%d}$`, assignProjectNameLength))
+	ids := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		err, id, hostedProjectPath := reserveProjectName(store, options.dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !idPattern.MatchString(id) {
+			t.Fatalf("id %q is not %d letters and digits", id, assignProjectNameLength)
+		}
+		if ids[id] {
+			t.Fatalf("id %s was given twice", id)
+		}
+		ids[id] = true
+		if hostedProjectPath != filepath.Join(options.dir, id) {
+			t.Fatalf("id %s is hosted at %s", id, hostedProjectPath)
+		}
+	}
+
+	err, id, _ := reserveProjectName(store, options.dir, "my-talk")
+	if err != nil || id != "my-talk" {
+		t.Fatalf("slug reserved as %q: %v", id, err)
+	}
+	if err, _, _ = reserveProjectName(store, options.dir, "my-talk"); err != errDuplicate {
+		t.Fatalf("slug reserved twice: %v", err)
+	}
+	for _, slug := range []string{"ab", "../escape", "with space", strings.Repeat("a", 65)} {
+		if err, _, _ = reserveProjectName(store, options.dir, slug); err == nil {
+			t.Fatalf("slug %q was accepted", slug)
+		}
+	}
+
+	// an id stored without its directory is still taken
+	err = store.InsertUpload(context.Background(), LiveUpload{AssignProjectName: "stored-only"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _, _ = reserveProjectName(store, options.dir, "stored-only"); err != errDuplicate {
+		t.Fatalf("stored id reserved again: %v", err)
+	}
+}
+
+func TestRecordingVisibility(t *testing.T) {
+	t.Parallel()
+	store, options := testUploads(t, Config{})
+	tokensPath := filepath.Join(filepath.Dir(options.dir), "tokens.json")
+	err := ioutil.WriteFile(tokensPath, []byte(`[{"token": "alice-token", "user": "alice"}, {"token": "bob-token", "user": "bob"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, auth := newAuthenticator(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]string{}
+	for _, visibility := range []string{visibilityPublic, visibilityUnlisted, visibilityPrivate} {
+		params := uploadParams{Owner: "alice", ProjectName: visibility, Visibility: visibility}
+		err, liveUpload := createUpload(store, params, uploadFormatTarball, bytes.NewReader(recordingTarball(t, 2)), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[visibility] = liveUpload.AssignProjectName
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/live", liveRequest(store, auth))
+	mux.HandleFunc("/api/liveList", liveListRequest(store, auth))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	call := func(method string, path string, token string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	replays := []struct {
+		id     string
+		token  string
+		status int
+	}{
+		{ids[visibilityPublic], "", http.StatusOK},
+		{ids[visibilityUnlisted], "", http.StatusOK},
+		{ids[visibilityPrivate], "", http.StatusForbidden},
+		{ids[visibilityPrivate], "wrong-token", http.StatusForbidden},
+		{ids[visibilityPrivate], "bob-token", http.StatusForbidden},
+		{ids[visibilityPrivate], "alice-token", http.StatusOK},
+		{"unknown", "alice-token", http.StatusNotFound},
+	}
+	for _, replay := range replays {
+		res := call("POST", "/api/live?id="+replay.id, replay.token)
+		res.Body.Close()
+		if res.StatusCode != replay.status {
+			t.Fatalf("replay of %s with %q: status %d, want %d", replay.id, replay.token, res.StatusCode, replay.status)
+		}
+	}
+	// EventSource clients pass the token in the query
+	res := call("POST", "/api/live?id="+ids[visibilityPrivate]+"&token=alice-token", "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("replay with a token query: status %d", res.StatusCode)
+	}
+
+	listings := []struct {
+		token string
+		names []string
+	}{
+		{"", []string{visibilityPublic}},
+		{"bob-token", []string{visibilityPublic}},
+		// the owner also sees the unlisted and private recordings
+		{"alice-token", []string{visibilityPublic, visibilityUnlisted, visibilityPrivate}},
+	}
+	for _, listing := range listings {
+		res := call("GET", "/api/liveList?order=asc", listing.token)
+		liveListResponse := LiveListResponse{}
+		err = json.NewDecoder(res.Body).Decode(&liveListResponse)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, item := range liveListResponse {
+			names = append(names, item.ProjectName)
+		}
+		sort.Strings(names)
+		want := append([]string{}, listing.names...)
+		sort.Strings(want)
+		if fmt.Sprint(names) != fmt.Sprint(want) {
+			t.Fatalf("listing for %q: %v, want %v", listing.token, names, want)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+type LiveSessionResponse struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+	URL string `json:"url"`
+}
+
+type LiveSessionsResponse []LiveSessionResponse
+
+type LiveAppendResponse struct {
+	Commits int `json:"commits"`
+}
+
+type LiveAppendsResponse []LiveAppendResponse
+
+// a viewer that falls this many commits behind is dropped
+const sessionSubscriberBuffer = 256
+
+// sessionHub fans out commits appended to a live session to the viewers
+// currently streaming it.
+type sessionHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Commit]bool
+	// one lock per recording keeps the commit ids of a session in order
+	// without holding up the other sessions
+	locks map[string]*sessionLock
+}
+
+type sessionLock struct {
+	sync.Mutex
+	users int
+}
+
+func newSessionHub() *sessionHub {
+	return &sessionHub{subs: map[string]map[chan Commit]bool{}, locks: map[string]*sessionLock{}}
+}
+
+// lock takes the lock of the recording and returns its unlock. Appends,
+// closes and changes of the recording hold it from reading the upload
+// until writing it back.
+func (h *sessionHub) lock(id string) func() {
+	h.mu.Lock()
+	l := h.locks[id]
+	if l == nil {
+		l = &sessionLock{}
+		h.locks[id] = l
+	}
+	l.users++
+	h.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(h.locks, id)
+		}
+	}
+}
+
+func (h *sessionHub) subscribe(id string) chan Commit {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Commit, sessionSubscriberBuffer)
+	if h.subs[id] == nil {
+		h.subs[id] = map[chan Commit]bool{}
+	}
+	h.subs[id][ch] = true
+	return ch
+}
+
+func (h *sessionHub) unsubscribe(id string, ch chan Commit) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.subs[id][ch] {
+		return
+	}
+	delete(h.subs[id], ch)
+	if len(h.subs[id]) == 0 {
+		delete(h.subs, id)
+	}
+	close(ch)
+}
+
+func (h *sessionHub) publish(id string, commit Commit) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[id] {
+		select {
+		case ch <- commit:
+		default:
+			delete(h.subs[id], ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every stream of the session.
+func (h *sessionHub) close(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[id] {
+		close(ch)
+	}
+	delete(h.subs, id)
+}
+
+func findLiveSession(ctx context.Context, store Store, id string, key string) (error, LiveUpload) {
+	err, liveUpload := store.FindUpload(ctx, id)
+	if err != nil {
+		return err, liveUpload
+	}
+	if liveUpload.Status != uploadStatusLive {
+		return fmt.Errorf("session %s is not live", id), liveUpload
+	}
+	if key == "" || key != liveUpload.SessionKey {
+		return errors.New("session key is invalid"), liveUpload
+	}
+	return nil, liveUpload
+}
+
+// newCommits lists the commits reachable from head but not from prevHead,
+// oldest first. head must be a descendant of prevHead.
+func newCommits(repo *git.Repository, prevHead plumbing.Hash, head plumbing.Hash) (error, []*object.Commit) {
+	cIter, err := repo.Log(&git.LogOptions{From: head})
+	if err != nil {
+		return err, nil
+	}
+
+	var commitObjects []*object.Commit
+	found := prevHead.IsZero()
+	err = cIter.ForEach(func(commitObj *object.Commit) error {
+		if commitObj.Hash == prevHead {
+			found = true
+			return storer.ErrStop
+		}
+		commitObjects = append(commitObjects, commitObj)
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+	if !found {
+		return fmt.Errorf("%s does not descend from %s", head, prevHead), nil
+	}
+
+	for i, j := 0, len(commitObjects)-1; i < j; i, j = i+1, j-1 {
+		commitObjects[i], commitObjects[j] = commitObjects[j], commitObjects[i]
+	}
+	return nil, commitObjects
+}
+
+// liveSessionRequest opens a session that the recording client appends
+// commits to while viewers follow it through the stream endpoint.
+func liveSessionRequest(store Store, auth *authenticator, options uploadOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "POST":
+			err, owner := auth.requireUser(r)
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			visibility := r.URL.Query().Get("visibility")
+			if visibility == "" {
+				visibility = visibilityPublic
+			}
+			err = validVisibility(visibility, owner)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			err, expiresAt := uploadExpiry(r.URL.Query(), options.ttl)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			projectName := r.URL.Query().Get("projectName")
+			if len(projectName) < 1 {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'projectName' is missing")
+				return
+			}
+
+			if strings.Contains(projectName, "/") || strings.Contains(projectName, "\\") {
+				responseErrorJSON(w, http.StatusInternalServerError, "invalid projectName.")
+				return
+			}
+
+			if _, err := os.Stat(options.dir); os.IsNotExist(err) {
+				err = os.Mkdir(options.dir, 0775)
+				if err != nil {
+					responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			}
+
+			absliveLogPath, err := filepath.Abs(options.dir)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, "open session failed")
+				return
+			}
+
+			err, assignProjectName, hostedProjectPath := reserveProjectName(store, absliveLogPath, r.URL.Query().Get("slug"))
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+			// the reserved directory would block the id forever
+			created := false
+			defer func() {
+				if !created {
+					os.RemoveAll(hostedProjectPath)
+				}
+			}()
+
+			err, sessionKey := randomText(32)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			_, err = git.PlainInit(hostedProjectPath, false)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			liveUpload := LiveUpload{
+				AssignProjectName:   assignProjectName,
+				OriginalProjectName: projectName,
+				HostedProjectPath:   hostedProjectPath,
+				Status:              uploadStatusLive,
+				SessionKey:          sessionKey,
+				CreatedAt:           nowMillis(),
+				Languages:           []string{},
+				Owner:               owner,
+				Visibility:          visibility,
+				ExpiresAt:           expiresAt,
+			}
+
+			err = store.InsertUpload(ctx, liveUpload)
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+			created = true
+
+			responseJSON(w, http.StatusOK, LiveSessionsResponse{LiveSessionResponse{
+				ID:  assignProjectName,
+				Key: liveUpload.SessionKey,
+				URL: liveViewURL + assignProjectName,
+			}})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only POST method is supported.")
+			return
+		}
+	}
+}
+
+// liveSessionAppendRequest takes a packfile with the new objects and the
+// hash of the new head commit, indexes the new commits and pushes them to
+// the viewers.
+func liveSessionAppendRequest(store Store, hub *sessionHub, options uploadOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "POST":
+			queryKeys := r.URL.Query()
+			id := queryKeys.Get("id")
+			head := queryKeys.Get("head")
+			if id == "" || head == "" {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'id' and 'head' are required")
+				return
+			}
+
+			defer hub.lock(id)()
+
+			// checked under the lock so a close cannot slip in before the
+			// commits are added
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err, liveUpload := findLiveSession(ctx, store, id, queryKeys.Get("key"))
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			repo, err := git.PlainOpen(liveUpload.HostedProjectPath)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			defer r.Body.Close()
+			body := newLimitedBody(r.Body, options.maxSize)
+			err = importPack(repo, body, options.limits)
+			if body.tooLarge() {
+				err = body.err()
+			}
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			masterName := plumbing.NewBranchReferenceName("master")
+			prevHead := plumbing.ZeroHash
+			ref, err := repo.Reference(masterName, true)
+			if err == nil {
+				prevHead = ref.Hash()
+			} else if err != plumbing.ErrReferenceNotFound {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			headHash := plumbing.NewHash(head)
+			err, commitObjects := newCommits(repo, prevHead, headHash)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			err, commitCount := store.CountCommits(ctx, liveUpload.HostedProjectPath)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			var commits Commits
+			for i, commitObject := range commitObjects {
+				commits = append(commits, Commit{
+					ProjectPath: liveUpload.HostedProjectPath,
+					ProjectName: liveUpload.OriginalProjectName,
+					Hash:        commitObject.Hash.String(),
+					Time:        commitTime(commitObject),
+					ID:          commitCount + i,
+				})
+			}
+
+			err = store.InsertCommits(ctx, commits)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			err = repo.Storer.SetReference(plumbing.NewHashReference(masterName, headHash))
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			if len(commits) > 0 {
+				liveUpload.addCommits(commits)
+				err = liveUpload.describeHead(repo, headHash.String())
+				if err == nil {
+					err = store.UpdateUpload(ctx, liveUpload)
+				}
+				if err != nil {
+					// only the listing summary is stale
+					log.Printf("error summarizing session %s: %v", id, err)
+				}
+			}
+
+			for _, commit := range commits {
+				hub.publish(id, commit)
+			}
+
+			go warmSnapshots(liveUpload.HostedProjectPath, commits)
+
+			responseJSON(w, http.StatusOK, LiveAppendsResponse{LiveAppendResponse{Commits: len(commits)}})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only POST method is supported.")
+			return
+		}
+	}
+}
+
+func liveSessionCloseRequest(store Store, hub *sessionHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "POST":
+			queryKeys := r.URL.Query()
+			id := queryKeys.Get("id")
+			if id == "" {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'id' is missing")
+				return
+			}
+
+			defer hub.lock(id)()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err, liveUpload := findLiveSession(ctx, store, id, queryKeys.Get("key"))
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			liveUpload.Status = uploadStatusClosed
+			err = store.UpdateUpload(ctx, liveUpload)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			hub.close(id)
+
+			responseJSON(w, http.StatusOK, LiveSessionsResponse{LiveSessionResponse{ID: id, URL: liveViewURL + id}})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only POST method is supported.")
+			return
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errNotFound  = errors.New("not found")
+	errDuplicate = errors.New("id is already taken")
+)
+
+// Store keeps the upload and commit documents of the recordings.
+type Store interface {
+	// InsertUpload returns errDuplicate when the id is already used.
+	InsertUpload(ctx context.Context, liveUpload LiveUpload) error
+	// FindUpload returns errNotFound when there is no upload with the id.
+	FindUpload(ctx context.Context, id string) (error, LiveUpload)
+	// UpdateUpload replaces the whole document, so the upload must have
+	// been read under sessionHub.lock, which is held until the update.
+	UpdateUpload(ctx context.Context, liveUpload LiveUpload) error
+	// CreateUpload inserts the upload together with its commits, or
+	// nothing at all.
+	CreateUpload(ctx context.Context, liveUpload LiveUpload, commits Commits) error
+	FindUploads(ctx context.Context, uploadQuery UploadQuery) (error, []LiveUpload)
+	// FindExpiredUploads returns the uploads that expired at or before now.
+	FindExpiredUploads(ctx context.Context, now int64) (error, []LiveUpload)
+	// DeleteUpload removes the upload and all of its commits.
+	DeleteUpload(ctx context.Context, liveUpload LiveUpload) error
+	InsertCommits(ctx context.Context, commits Commits) error
+	// FindCommits returns the commits of the project selected by the
+	// query ordered by id, at most limit of them when limit > 0.
+	FindCommits(ctx context.Context, projectPath string, replayQuery ReplayQuery, limit int) (error, Commits)
+	CountCommits(ctx context.Context, projectPath string) (error, int)
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+const (
+	storageMongo = "mongo"
+	storageFile  = "file"
+)
+
+func newStore(config Config) (error, Store) {
+	switch config.Storage {
+	case "", storageMongo:
+		err, s := newMongoStore(config.Mongo)
+		if err != nil {
+			return err, nil
+		}
+		return nil, s
+	case storageFile:
+		return nil, &fileStore{dir: filepath.Join(liveLogPath, ".store")}
+	default:
+		return errors.New("storage must be 'mongo' or 'file'"), nil
+	}
+}
+
+func (q UploadQuery) match(liveUpload LiveUpload) bool {
+	if !liveUpload.listedTo(q.Viewer) {
+		return false
+	}
+	if q.Name != "" && !strings.Contains(strings.ToLower(liveUpload.OriginalProjectName), strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.Lang == "" {
+		return true
+	}
+	for _, lang := range liveUpload.Languages {
+		if lang == q.Lang {
+			return true
+		}
+	}
+	return false
+}
+
+func (q UploadQuery) less(a LiveUpload, b LiveUpload) bool {
+	if q.Sort == uploadSortLength {
+		if q.Desc {
+			return a.Duration > b.Duration
+		}
+		return a.Duration < b.Duration
+	}
+	if q.Desc {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.CreatedAt < b.CreatedAt
+}
+
+func (q ReplayQuery) match(commit Commit) bool {
+	if commit.ID < q.Cursor {
+		return false
+	}
+	if q.From != nil && commit.Time < *q.From {
+		return false
+	}
+	if q.To != nil && commit.Time > *q.To {
+		return false
+	}
+	return true
+}
+
+// fileStore keeps the documents as JSON files, one file for the uploads
+// and one per project for its commits. It needs no database and is meant
+// for running on a laptop or in tests.
+type fileStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func (s *fileStore) uploadsPath() string {
+	return filepath.Join(s.dir, "uploads.json")
+}
+
+func (s *fileStore) commitsPath(projectPath string) string {
+	return filepath.Join(s.dir, "commits", filepath.Base(projectPath)+".json")
+}
+
+func (s *fileStore) read(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// write replaces the file through a rename so readers never see half of it.
+func (s *fileStore) write(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0775)
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// Ping makes sure documents can be written: the directory is created
+// when missing and a file is written to it.
+func (s *fileStore) Ping(ctx context.Context) error {
+	err := os.MkdirAll(s.dir, 0775)
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(s.dir, ".ping-")
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+	return os.Remove(tempFile.Name())
+}
+
+func (s *fileStore) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *fileStore) readUploads() (error, []LiveUpload) {
+	var liveUploads []LiveUpload
+	err := s.read(s.uploadsPath(), &liveUploads)
+	return err, liveUploads
+}
+
+func (s *fileStore) InsertUpload(ctx context.Context, liveUpload LiveUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err, liveUploads := s.readUploads()
+	if err != nil {
+		return err
+	}
+	for _, u := range liveUploads {
+		if u.AssignProjectName == liveUpload.AssignProjectName {
+			return errDuplicate
+		}
+	}
+	return s.write(s.uploadsPath(), append(liveUploads, liveUpload))
+}
+
+func (s *fileStore) CreateUpload(ctx context.Context, liveUpload LiveUpload, commits Commits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err, liveUploads := s.readUploads()
+	if err != nil {
+		return err
+	}
+	for _, u := range liveUploads {
+		if u.AssignProjectName == liveUpload.AssignProjectName {
+			return errDuplicate
+		}
+	}
+
+	// the commits file is unreachable until the upload is written
+	commitsPath := s.commitsPath(liveUpload.HostedProjectPath)
+	err = s.write(commitsPath, commits)
+	if err != nil {
+		return err
+	}
+	err = s.write(s.uploadsPath(), append(liveUploads, liveUpload))
+	if err != nil {
+		os.Remove(commitsPath)
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) FindUpload(ctx context.Context, id string) (error, LiveUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err, liveUploads := s.readUploads()
+	if err != nil {
+		return err, LiveUpload{}
+	}
+	for _, liveUpload := range liveUploads {
+		if liveUpload.AssignProjectName == id {
+			return nil, liveUpload
+		}
+	}
+	return errNotFound, LiveUpload{}
+}
+
+func (s *fileStore) UpdateUpload(ctx context.Context, liveUpload LiveUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err, liveUploads := s.readUploads()
+	if err != nil {
+		return err
+	}
+	for i := range liveUploads {
+		if liveUploads[i].AssignProjectName == liveUpload.AssignProjectName {
+			liveUploads[i] = liveUpload
+			return s.write(s.uploadsPath(), liveUploads)
+		}
+	}
+	return errNotFound
+}
+
+func (s *fileStore) FindUploads(ctx context.Context, uploadQuery UploadQuery) (error, []LiveUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err, stored := s.readUploads()
+	if err != nil {
+		return err, nil
+	}
+
+	liveUploads := []LiveUpload{}
+	for _, liveUpload := range stored {
+		if uploadQuery.match(liveUpload) {
+			liveUploads = append(liveUploads, liveUpload)
+		}
+	}
+	sort.SliceStable(liveUploads, func(i, j int) bool {
+		return uploadQuery.less(liveUploads[i], liveUploads[j])
+	})
+	return nil, liveUploads
+}
+
+func (s *fileStore) FindExpiredUploads(ctx context.Context, now int64) (error, []LiveUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err, stored := s.readUploads()
+	if err != nil {
+		return err, nil
+	}
+
+	liveUploads := []LiveUpload{}
+	for _, liveUpload := range stored {
+		if liveUpload.expired(now) {
+			liveUploads = append(liveUploads, liveUpload)
+		}
+	}
+	return nil, liveUploads
+}
+
+func (s *fileStore) DeleteUpload(ctx context.Context, liveUpload LiveUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err, stored := s.readUploads()
+	if err != nil {
+		return err
+	}
+
+	liveUploads := []LiveUpload{}
+	for _, u := range stored {
+		if u.AssignProjectName != liveUpload.AssignProjectName {
+			liveUploads = append(liveUploads, u)
+		}
+	}
+	if len(liveUploads) == len(stored) {
+		return errNotFound
+	}
+
+	// commits go first, a failure part way leaves an upload that can
+	// simply be deleted again
+	err = os.Remove(s.commitsPath(liveUpload.HostedProjectPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.write(s.uploadsPath(), liveUploads)
+}
+
+func (s *fileStore) InsertCommits(ctx context.Context, commits Commits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byProject := map[string]Commits{}
+	for _, commit := range commits {
+		byProject[commit.ProjectPath] = append(byProject[commit.ProjectPath], commit)
+	}
+
+	for projectPath, projectCommits := range byProject {
+		var stored Commits
+		err := s.read(s.commitsPath(projectPath), &stored)
+		if err != nil {
+			return err
+		}
+		err = s.write(s.commitsPath(projectPath), append(stored, projectCommits...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) FindCommits(ctx context.Context, projectPath string, replayQuery ReplayQuery, limit int) (error, Commits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored Commits
+	err := s.read(s.commitsPath(projectPath), &stored)
+	if err != nil {
+		return err, nil
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+
+	commits := Commits{}
+	for _, commit := range stored {
+		if commit.ProjectPath != projectPath || !replayQuery.match(commit) {
+			continue
+		}
+		commits = append(commits, commit)
+		if limit > 0 && len(commits) == limit {
+			break
+		}
+	}
+	return nil, commits
+}
+
+func (s *fileStore) CountCommits(ctx context.Context, projectPath string) (error, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored Commits
+	err := s.read(s.commitsPath(projectPath), &stored)
+	return err, len(stored)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type MongoConfig struct {
+	URI      string `json:"uri"`
+	Database string `json:"database"`
+	// timeouts in seconds
+	ConnectTimeout         int    `json:"connectTimeout"`
+	ServerSelectionTimeout int    `json:"serverSelectionTimeout"`
+	MaxPoolSize            uint64 `json:"maxPoolSize"`
+	MinPoolSize            uint64 `json:"minPoolSize"`
+}
+
+// mongoStore keeps the documents in the "upload" and "commit" collections.
+// The client is shared by all requests and pools its connections.
+type mongoStore struct {
+	client   *mongo.Client
+	database *mongo.Database
+}
+
+func newMongoStore(config MongoConfig) (error, *mongoStore) {
+	if config.URI == "" {
+		config.URI = "mongodb://localhost:27017"
+	}
+	if config.Database == "" {
+		config.Database = "liveCoding"
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = 10
+	}
+	if config.ServerSelectionTimeout == 0 {
+		config.ServerSelectionTimeout = 10
+	}
+
+	clientOptions := options.Client().
+		ApplyURI(config.URI).
+		SetConnectTimeout(time.Duration(config.ConnectTimeout) * time.Second).
+		SetServerSelectionTimeout(time.Duration(config.ServerSelectionTimeout) * time.Second)
+	if config.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(config.MaxPoolSize)
+	}
+	if config.MinPoolSize > 0 {
+		clientOptions.SetMinPoolSize(config.MinPoolSize)
+	}
+
+	client, err := mongo.NewClient(clientOptions)
+	if err != nil {
+		return err, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ConnectTimeout)*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return err, nil
+	}
+
+	s := &mongoStore{client: client, database: client.Database(config.Database)}
+	err = s.Ping(ctx)
+	if err != nil {
+		client.Disconnect(ctx)
+		return err, nil
+	}
+
+	// ids are random, the index makes a collision fail instead of
+	// silently sharing an id
+	_, err = s.database.Collection("upload").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"assign_project_name": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return err, nil
+	}
+	return nil, s
+}
+
+func (s *mongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+func (q ReplayQuery) filter(projectPath string) bson.M {
+	filter := bson.M{"project_path": projectPath}
+	if q.Cursor > 0 {
+		filter["id"] = bson.M{"$gte": q.Cursor}
+	}
+	if q.From != nil || q.To != nil {
+		timeFilter := bson.M{}
+		if q.From != nil {
+			timeFilter["$gte"] = *q.From
+		}
+		if q.To != nil {
+			timeFilter["$lte"] = *q.To
+		}
+		filter["time"] = timeFilter
+	}
+	return filter
+}
+
+func (s *mongoStore) InsertUpload(ctx context.Context, liveUpload LiveUpload) error {
+	_, err := s.database.Collection("upload").InsertOne(ctx, liveUpload)
+	if isDuplicateKey(err) {
+		return errDuplicate
+	}
+	return err
+}
+
+// CreateUpload inserts the documents in a transaction. A standalone server
+// has no transactions, there the upload is inserted after its commits and
+// the commits are removed again when it fails.
+func (s *mongoStore) CreateUpload(ctx context.Context, liveUpload LiveUpload, commits Commits) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, s.insertUploadAndCommits(sessCtx, liveUpload, commits)
+	})
+	if !transactionsUnsupported(err) {
+		if isDuplicateKey(err) {
+			return errDuplicate
+		}
+		return err
+	}
+
+	// removing the commits again must not touch those of the upload
+	// that already has the id
+	err, _ = s.FindUpload(ctx, liveUpload.AssignProjectName)
+	if err != errNotFound {
+		if err == nil {
+			return errDuplicate
+		}
+		return err
+	}
+	err = s.insertUploadAndCommits(ctx, liveUpload, commits)
+	if err != nil {
+		s.database.Collection("commit").DeleteMany(ctx, bson.M{"project_path": liveUpload.HostedProjectPath})
+		if isDuplicateKey(err) {
+			return errDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *mongoStore) insertUploadAndCommits(ctx context.Context, liveUpload LiveUpload, commits Commits) error {
+	err := s.InsertCommits(ctx, commits)
+	if err != nil {
+		return err
+	}
+	_, err = s.database.Collection("upload").InsertOne(ctx, liveUpload)
+	return err
+}
+
+// IllegalOperation is returned by standalone servers, which only support
+// transactions on replica sets and sharded clusters.
+func transactionsUnsupported(err error) bool {
+	commandError, ok := err.(mongo.CommandError)
+	return ok && commandError.Code == 20
+}
+
+func isDuplicateKey(err error) bool {
+	writeException, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+	for _, writeError := range writeException.WriteErrors {
+		if writeError.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *mongoStore) FindUpload(ctx context.Context, id string) (error, LiveUpload) {
+	liveUpload := LiveUpload{}
+
+	filter := bson.M{"assign_project_name": id}
+	err := s.database.Collection("upload").FindOne(ctx, filter).Decode(&liveUpload)
+	if err == mongo.ErrNoDocuments {
+		return errNotFound, liveUpload
+	}
+	return err, liveUpload
+}
+
+func (s *mongoStore) UpdateUpload(ctx context.Context, liveUpload LiveUpload) error {
+	filter := bson.M{"assign_project_name": liveUpload.AssignProjectName}
+	result, err := s.database.Collection("upload").ReplaceOne(ctx, filter, liveUpload)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (q UploadQuery) filter() bson.M {
+	// public, or missing visibility from before it existed
+	listed := bson.A{bson.M{"visibility": bson.M{"$in": bson.A{visibilityPublic, nil}}}}
+	if q.Viewer != "" {
+		listed = append(listed, bson.M{"owner": q.Viewer})
+	}
+	filter := bson.M{"$or": listed}
+	if q.Name != "" {
+		filter["original_project_name"] = primitive.Regex{Pattern: regexp.QuoteMeta(q.Name), Options: "i"}
+	}
+	if q.Lang != "" {
+		filter["languages"] = q.Lang
+	}
+	return filter
+}
+
+func (s *mongoStore) FindUploads(ctx context.Context, uploadQuery UploadQuery) (error, []LiveUpload) {
+	sortKey := "created_at"
+	if uploadQuery.Sort == uploadSortLength {
+		sortKey = "duration"
+	}
+	sortOrder := 1
+	if uploadQuery.Desc {
+		sortOrder = -1
+	}
+
+	findOptions := options.Find().SetSort(bson.M{sortKey: sortOrder})
+	cur, err := s.database.Collection("upload").Find(ctx, uploadQuery.filter(), findOptions)
+	if err != nil {
+		return err, nil
+	}
+
+	liveUploads := []LiveUpload{}
+	err = cur.All(ctx, &liveUploads)
+	if err != nil {
+		return err, nil
+	}
+	return nil, liveUploads
+}
+
+func (s *mongoStore) FindExpiredUploads(ctx context.Context, now int64) (error, []LiveUpload) {
+	filter := bson.M{"expires_at": bson.M{"$gt": 0, "$lte": now}}
+	cur, err := s.database.Collection("upload").Find(ctx, filter)
+	if err != nil {
+		return err, nil
+	}
+
+	liveUploads := []LiveUpload{}
+	err = cur.All(ctx, &liveUploads)
+	if err != nil {
+		return err, nil
+	}
+	return nil, liveUploads
+}
+
+// DeleteUpload removes the upload and its commits in a transaction. A
+// standalone server has no transactions, there the commits are read
+// before they are removed and put back when removing the upload fails.
+func (s *mongoStore) DeleteUpload(ctx context.Context, liveUpload LiveUpload) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, s.deleteUploadAndCommits(sessCtx, liveUpload)
+	})
+	if !transactionsUnsupported(err) {
+		return err
+	}
+
+	err, commits := s.FindCommits(ctx, liveUpload.HostedProjectPath, ReplayQuery{}, 0)
+	if err != nil {
+		return err
+	}
+	err = s.deleteUploadAndCommits(ctx, liveUpload)
+	if err != nil {
+		s.database.Collection("commit").DeleteMany(ctx, bson.M{"project_path": liveUpload.HostedProjectPath})
+		s.InsertCommits(ctx, commits)
+		return err
+	}
+	return nil
+}
+
+func (s *mongoStore) deleteUploadAndCommits(ctx context.Context, liveUpload LiveUpload) error {
+	_, err := s.database.Collection("commit").DeleteMany(ctx, bson.M{"project_path": liveUpload.HostedProjectPath})
+	if err != nil {
+		return err
+	}
+
+	result, err := s.database.Collection("upload").DeleteOne(ctx, bson.M{"assign_project_name": liveUpload.AssignProjectName})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) InsertCommits(ctx context.Context, commits Commits) error {
+	if len(commits) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, len(commits))
+	for i, commit := range commits {
+		documents[i] = commit
+	}
+	_, err := s.database.Collection("commit").InsertMany(ctx, documents)
+	return err
+}
+
+func (s *mongoStore) FindCommits(ctx context.Context, projectPath string, replayQuery ReplayQuery, limit int) (error, Commits) {
+	findOptions := options.Find().SetSort(bson.M{"id": 1})
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+	cur, err := s.database.Collection("commit").Find(ctx, replayQuery.filter(projectPath), findOptions)
+	if err != nil {
+		return err, nil
+	}
+
+	commits := Commits{}
+	err = cur.All(ctx, &commits)
+	if err != nil {
+		return err, nil
+	}
+	return nil, commits
+}
+
+func (s *mongoStore) CountCommits(ctx context.Context, projectPath string) (error, int) {
+	count, err := s.database.Collection("commit").CountDocuments(ctx, bson.M{"project_path": projectPath})
+	return err, int(count)
+}
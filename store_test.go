@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testStoreContract checks the behavior every Store backend must share.
+func testStoreContract(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	err := store.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err, _ := store.FindUpload(ctx, "missing"); err != errNotFound {
+		t.Fatalf("FindUpload of a missing upload: %v", err)
+	}
+	if err = store.UpdateUpload(ctx, LiveUpload{AssignProjectName: "missing"}); err != errNotFound {
+		t.Fatalf("UpdateUpload of a missing upload: %v", err)
+	}
+	if err = store.DeleteUpload(ctx, LiveUpload{AssignProjectName: "missing", HostedProjectPath: "/hosted/missing"}); err != errNotFound {
+		t.Fatalf("DeleteUpload of a missing upload: %v", err)
+	}
+
+	upload := func(id string, createdAt int64, duration int64, expiresAt int64) LiveUpload {
+		return LiveUpload{
+			AssignProjectName:   id,
+			OriginalProjectName: "project " + id,
+			HostedProjectPath:   "/hosted/" + id,
+			Visibility:          visibilityPublic,
+			CreatedAt:           createdAt,
+			Duration:            duration,
+			ExpiresAt:           expiresAt,
+			Languages:           []string{"python"},
+		}
+	}
+	commits := func(liveUpload LiveUpload, count int) Commits {
+		var commits Commits
+		for i := 0; i < count; i++ {
+			commits = append(commits, Commit{
+				ProjectPath: liveUpload.HostedProjectPath,
+				ProjectName: liveUpload.OriginalProjectName,
+				Hash:        fmt.Sprintf("%040d", i),
+				Time:        int64(1000 * (i + 1)),
+				ID:          i,
+			})
+		}
+		return commits
+	}
+
+	a := upload("a", 1, 300, 0)
+	err = store.InsertUpload(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertUpload(ctx, a); err != errDuplicate {
+		t.Fatalf("InsertUpload of a taken id: %v", err)
+	}
+	err = store.InsertCommits(ctx, commits(a, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := upload("b", 2, 100, 50)
+	err = store.CreateUpload(ctx, b, commits(b, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateUpload(ctx, a, nil); err != errDuplicate {
+		t.Fatalf("CreateUpload of a taken id: %v", err)
+	}
+
+	err, found := store.FindUpload(ctx, "b")
+	if err != nil || found.OriginalProjectName != b.OriginalProjectName || found.ExpiresAt != 50 {
+		t.Fatalf("FindUpload gave %+v, %v", found, err)
+	}
+	found.OriginalProjectName = "renamed"
+	err = store.UpdateUpload(ctx, found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, found = store.FindUpload(ctx, "b"); err != nil || found.OriginalProjectName != "renamed" {
+		t.Fatalf("updated upload is %+v, %v", found, err)
+	}
+
+	listings := []struct {
+		uploadQuery UploadQuery
+		ids         []string
+	}{
+		{UploadQuery{Sort: uploadSortDate}, []string{"a", "b"}},
+		{UploadQuery{Sort: uploadSortDate, Desc: true}, []string{"b", "a"}},
+		{UploadQuery{Sort: uploadSortLength}, []string{"b", "a"}},
+		{UploadQuery{Sort: uploadSortDate, Name: "RENAMED"}, []string{"b"}},
+		{UploadQuery{Sort: uploadSortDate, Lang: "go"}, []string{}},
+	}
+	for _, listing := range listings {
+		err, liveUploads := store.FindUploads(ctx, listing.uploadQuery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, liveUpload := range liveUploads {
+			ids = append(ids, liveUpload.AssignProjectName)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(listing.ids) {
+			t.Fatalf("FindUploads(%+v) gave %v, want %v", listing.uploadQuery, ids, listing.ids)
+		}
+	}
+
+	err, expired := store.FindExpiredUploads(ctx, 50)
+	if err != nil || len(expired) != 1 || expired[0].AssignProjectName != "b" {
+		t.Fatalf("FindExpiredUploads gave %+v, %v", expired, err)
+	}
+	if err, expired = store.FindExpiredUploads(ctx, 49); err != nil || len(expired) != 0 {
+		t.Fatalf("FindExpiredUploads before the expiry gave %+v, %v", expired, err)
+	}
+
+	from := int64(2000)
+	replays := []struct {
+		replayQuery ReplayQuery
+		limit       int
+		ids         []int
+	}{
+		{ReplayQuery{}, 0, []int{0, 1, 2, 3, 4}},
+		{ReplayQuery{Cursor: 3}, 0, []int{3, 4}},
+		{ReplayQuery{}, 2, []int{0, 1}},
+		{ReplayQuery{From: &from}, 2, []int{1, 2}},
+	}
+	for _, replay := range replays {
+		err, found := store.FindCommits(ctx, b.HostedProjectPath, replay.replayQuery, replay.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, commit := range found {
+			ids = append(ids, commit.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(replay.ids) {
+			t.Fatalf("FindCommits(%+v, %d) gave %v, want %v", replay.replayQuery, replay.limit, ids, replay.ids)
+		}
+	}
+	if err, count := store.CountCommits(ctx, a.HostedProjectPath); err != nil || count != 3 {
+		t.Fatalf("CountCommits gave %d, %v", count, err)
+	}
+
+	err = store.DeleteUpload(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ = store.FindUpload(ctx, "b"); err != errNotFound {
+		t.Fatalf("deleted upload is still found: %v", err)
+	}
+	if err, count := store.CountCommits(ctx, b.HostedProjectPath); err != nil || count != 0 {
+		t.Fatalf("deleted upload keeps %d commits, %v", count, err)
+	}
+	if err, count := store.CountCommits(ctx, a.HostedProjectPath); err != nil || count != 3 {
+		t.Fatalf("deleting another upload left %d commits, %v", count, err)
+	}
+	if err = store.DeleteUpload(ctx, b); err != errNotFound {
+		t.Fatalf("DeleteUpload of a deleted upload: %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	t.Parallel()
+	store := &fileStore{dir: filepath.Join(t.TempDir(), ".store")}
+	testStoreContract(t, store)
+
+	// a store that cannot write is reported by the health check
+	store = &fileStore{dir: filepath.Join(store.dir, "uploads.json")}
+	if err := store.Ping(context.Background()); err == nil {
+		t.Fatal("Ping of a file succeeded")
+	}
+}
+
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+
+	err, database := randomText(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, store := newMongoStore(MongoConfig{URI: uri, Database: "liveCodingTest" + database})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.database.Drop(context.Background())
+		store.Close(context.Background())
+	}()
+	testStoreContract(t, store)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	streamPaceFast     = "fast"
+	streamPaceRealtime = "realtime"
+)
+
+// recorded times are in milliseconds; long idle gaps are shortened so a
+// viewer is never left waiting on a frozen frame
+const maxStreamFrameDelay = 10 * time.Second
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, data interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dataJSON)
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+func frameDelay(prevTime int64, nextTime int64) time.Duration {
+	if prevTime < 0 || nextTime <= prevTime {
+		return 0
+	}
+	delay := time.Duration(nextTime-prevTime) * time.Millisecond
+	if delay > maxStreamFrameDelay {
+		return maxStreamFrameDelay
+	}
+	return delay
+}
+
+// liveStreamRequest pushes the replay frames of a recording as Server-Sent
+// Events, building each frame only when it is about to be sent. With
+// follow=1 the stream of a live session stays open and receives every
+// commit appended to it until the session is closed.
+func liveStreamRequest(store Store, auth *authenticator, hub *sessionHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "GET":
+			queryKeys := r.URL.Query()
+
+			queryKey, ok := queryKeys["id"]
+
+			if !ok || len(queryKey[0]) < 1 {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'id' is missing")
+				return
+			}
+
+			id := queryKey[0]
+
+			pace := queryKeys.Get("pace")
+			if pace == "" {
+				pace = streamPaceFast
+			}
+			if pace != streamPaceFast && pace != streamPaceRealtime {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'pace' must be 'fast' or 'realtime'")
+				return
+			}
+
+			err, replayQuery := parseReplayQuery(queryKeys)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			follow := queryKeys.Get("follow") == "1"
+
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				responseErrorJSON(w, http.StatusInternalServerError, "streaming is not supported")
+				return
+			}
+
+			// subscribe before reading the stored commits so nothing
+			// appended in between is missed
+			var appended chan Commit
+			if follow {
+				appended = hub.subscribe(id)
+				defer hub.unsubscribe(id, appended)
+			}
+
+			// only the commit documents are loaded up front, the frames
+			// themselves are built while streaming
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err, liveUpload, livesResponse := findLiveCommits(ctx, store, id, auth.user(r), replayQuery)
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			more := replayQuery.Limit > 0 && len(livesResponse) > replayQuery.Limit
+			if more {
+				livesResponse = livesResponse[:replayQuery.Limit]
+			}
+
+			err, builder := newFrameBuilder(liveUpload, replayQuery.Format)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
+
+			lastID := -1
+			var lastTime int64 = -1
+			sendFrames := func(livesResponse LivesResponse) bool {
+				for i := 0; i < len(livesResponse); i++ {
+					if pace == streamPaceRealtime && lastID >= 0 {
+						select {
+						case <-time.After(frameDelay(lastTime, livesResponse[i].Time)):
+						case <-r.Context().Done():
+							return false
+						}
+					}
+
+					err, liveResponse := builder.build(livesResponse[i])
+					if err != nil {
+						writeEvent(w, flusher, "error", ErrorsResponse{ErrorResponse{Message: err.Error()}})
+						return false
+					}
+
+					err = writeEvent(w, flusher, "frame", liveResponse)
+					if err != nil {
+						// the viewer went away
+						return false
+					}
+					lastID, lastTime = liveResponse.ID, liveResponse.Time
+				}
+				return true
+			}
+
+			if !sendFrames(livesResponse) {
+				return
+			}
+
+			// a limited page only starts a followed stream: the stored
+			// commits after it are caught up from the last frame sent
+			// before waiting for appended ones
+			for follow && more && liveUpload.Status == uploadStatusLive {
+				replayQuery.Cursor = lastID + 1
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				err, _, livesResponse = findLiveCommits(ctx, store, id, auth.user(r), replayQuery)
+				cancel()
+				if err != nil {
+					writeEvent(w, flusher, "error", ErrorsResponse{ErrorResponse{Message: err.Error()}})
+					return
+				}
+				more = len(livesResponse) > replayQuery.Limit
+				if more {
+					livesResponse = livesResponse[:replayQuery.Limit]
+				}
+				if !sendFrames(livesResponse) {
+					return
+				}
+			}
+
+			for follow && liveUpload.Status == uploadStatusLive {
+				var commit Commit
+				select {
+				case commit, ok = <-appended:
+				case <-r.Context().Done():
+					return
+				}
+				if !ok {
+					// closed, or the viewer fell too far behind
+					break
+				}
+				if commit.ID <= lastID {
+					continue
+				}
+
+				liveResponse := commit.liveResponse()
+				liveResponse.ProjectName = liveUpload.OriginalProjectName
+				err, liveResponse = builder.build(liveResponse)
+				if err != nil {
+					writeEvent(w, flusher, "error", ErrorsResponse{ErrorResponse{Message: err.Error()}})
+					return
+				}
+
+				err = writeEvent(w, flusher, "frame", liveResponse)
+				if err != nil {
+					return
+				}
+				lastID = liveResponse.ID
+			}
+
+			writeEvent(w, flusher, "end", struct{}{})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET method is supported.")
+			return
+		}
+	}
+}
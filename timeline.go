@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"liveCoding-api/util"
+	"net/http"
+	"sort"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// Chapter is a heading or chapter annotation at the frame it first
+// appears in.
+type Chapter struct {
+	Title string `json:"title"`
+	Kind  string `json:"kind"`
+	ID    int    `json:"id"`
+	Time  int64  `json:"time"`
+	Hash  string `json:"hash"`
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+}
+
+type TimelineResponse struct {
+	ID       string    `json:"id"`
+	Chapters []Chapter `json:"chapters"`
+}
+
+type TimelinesResponse []TimelineResponse
+
+// buildTimeline walks the frames in order and keeps every heading and
+// chapter the first time it shows up, so the player can navigate without
+// loading every frame.
+func buildTimeline(liveUpload LiveUpload, livesResponse LivesResponse) (error, TimelineResponse) {
+	repo, err := git.PlainOpen(liveUpload.HostedProjectPath)
+	if err != nil {
+		return err, TimelineResponse{}
+	}
+
+	type chapterKey struct {
+		file  string
+		kind  string
+		title string
+	}
+	seen := map[chapterKey]bool{}
+	chapters := []Chapter{}
+	for _, liveResponse := range livesResponse {
+		err, snapshot := readSnapshot(repo, liveUpload.HostedProjectPath, liveResponse.Hash)
+		if err != nil {
+			return err, TimelineResponse{}
+		}
+
+		var frameChapters []Chapter
+		for filePath, info := range snapshot {
+			file := liveUpload.OriginalProjectName + "/" + filePath
+			for _, annotation := range info.Annotations {
+				if annotation.Kind != util.AnnotationHeading && annotation.Kind != util.AnnotationChapter {
+					continue
+				}
+				key := chapterKey{file, annotation.Kind, annotation.Content}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				frameChapters = append(frameChapters, Chapter{
+					Title: annotation.Content,
+					Kind:  annotation.Kind,
+					ID:    liveResponse.ID,
+					Time:  liveResponse.Time,
+					Hash:  liveResponse.Hash,
+					File:  file,
+					Line:  annotation.Line,
+				})
+			}
+		}
+		// files of a snapshot come in no particular order
+		sort.Slice(frameChapters, func(i, j int) bool {
+			if frameChapters[i].File != frameChapters[j].File {
+				return frameChapters[i].File < frameChapters[j].File
+			}
+			return frameChapters[i].Line < frameChapters[j].Line
+		})
+		chapters = append(chapters, frameChapters...)
+	}
+
+	return nil, TimelineResponse{ID: liveUpload.AssignProjectName, Chapters: chapters}
+}
+
+func liveTimelineRequest(store Store, auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			CORSforOptions(&w)
+			return
+		case "GET":
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				responseErrorJSON(w, http.StatusInternalServerError, "url query 'id' is missing")
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err, liveUpload, livesResponse := findLiveCommits(ctx, store, id, auth.user(r), ReplayQuery{})
+			if err != nil {
+				responseErrorJSON(w, errorStatus(err), err.Error())
+				return
+			}
+
+			err, timelineResponse := buildTimeline(liveUpload, livesResponse)
+			if err != nil {
+				responseErrorJSON(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			responseJSON(w, http.StatusOK, TimelinesResponse{timelineResponse})
+		default:
+			responseErrorJSON(w, http.StatusMethodNotAllowed, "Sorry, only GET method is supported.")
+			return
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotation kinds, each also the key that writes it:
+//
+//	//@ "heading": "Setup"
+//	//@ "note": "the loop starts at 1"
+//	//@ "highlight": "3-7"          lines 3 to 7, or a single "3"
+//	//@ "pause": 1500               milliseconds, or "1.5s"
+//	//@ "chapter": "Parsing"
+//	//@ "focus": "src/main.py"
+//	//@ "hide": "10-20"             or "start" and "end" around the lines
+//
+// The old "content" key is a heading.
+const (
+	AnnotationHeading   = "heading"
+	AnnotationNote      = "note"
+	AnnotationHighlight = "highlight"
+	AnnotationPause     = "pause"
+	AnnotationChapter   = "chapter"
+	AnnotationFocus     = "focus"
+	AnnotationHide      = "hide"
+)
+
+// a pause longer than this is a mistake
+const maxPause = 10 * time.Minute
+
+// Annotation is one annotation of a file. Line is the 1-based line of the
+// comment; From and To are the 1-based lines a highlight or hide covers.
+type Annotation struct {
+	Line     int    `json:"line" bson:"line"`
+	Kind     string `json:"kind" bson:"kind"`
+	Content  string `json:"content,omitempty" bson:"content,omitempty"`
+	From     int    `json:"from,omitempty" bson:"from,omitempty"`
+	To       int    `json:"to,omitempty" bson:"to,omitempty"`
+	Duration int64  `json:"duration,omitempty" bson:"duration,omitempty"`
+	File     string `json:"file,omitempty" bson:"file,omitempty"`
+}
+
+// AnnotationError reports an annotation that could not be used.
+type AnnotationError struct {
+	Line    int    `json:"line" bson:"line"`
+	Message string `json:"message" bson:"message"`
+}
+
+// ParseAnnotations collects every annotation comment of the code, in the
+// order they appear. Broken annotations are reported and left out.
+//
+// An annotation is a line comment starting with @, or a block comment or
+// docstring starting with @, optionally after spaces:
+//
+//	//@ "heading": "Setup"
+//	/* @ "note": "x" */
+//	"""@ "chapter": "Parsing" """
+//
+// Block comments and docstrings may span lines. A line comment annotation
+// ending with "," continues with the keys of the plain comments below it,
+// one ending with "\" continues its text there.
+func ParseAnnotations(code string, lang string, basename string) (error, []Annotation, []AnnotationError) {
+	language, ok := Languages.Lookup(lang)
+	if !ok || language.CommentMark() == "" && len(language.Docstrings) == 0 {
+		return errors.New("unsupport lang"), nil, nil
+	}
+
+	lines := strings.Split(code, "\n")
+	scanner := annotationScanner{language: language, basename: basename, lines: lines}
+	annotations := []Annotation{}
+	annotationErrors := []AnnotationError{}
+	hideStart := 0
+	for i := 0; i < len(lines); i++ {
+		lineNumber := i + 1
+		err, found, body, last := scanner.scan(i)
+		if !found {
+			continue
+		}
+		i = last
+		if err != nil {
+			annotationErrors = append(annotationErrors, AnnotationError{Line: lineNumber, Message: err.Error()})
+			continue
+		}
+
+		err, lineAnnotations, keyErrors := parseAnnotationLine(body, lineNumber, len(lines))
+		if err != nil {
+			annotationErrors = append(annotationErrors, AnnotationError{Line: lineNumber, Message: err.Error()})
+			continue
+		}
+		annotationErrors = append(annotationErrors, keyErrors...)
+
+		for _, annotation := range lineAnnotations {
+			if annotation.Kind != AnnotationHide || annotation.From != 0 {
+				annotations = append(annotations, annotation)
+				continue
+			}
+			// markers: the lines between start and end are hidden
+			switch annotation.Content {
+			case "start":
+				if hideStart != 0 {
+					annotationErrors = append(annotationErrors, AnnotationError{Line: lineNumber, Message: fmt.Sprintf("hide already started on line %d", hideStart)})
+					continue
+				}
+				hideStart = lineNumber
+			case "end":
+				if hideStart == 0 {
+					annotationErrors = append(annotationErrors, AnnotationError{Line: lineNumber, Message: "hide ends without a start"})
+					continue
+				}
+				annotations = append(annotations, Annotation{Line: hideStart, Kind: AnnotationHide, From: hideStart, To: last + 1})
+				hideStart = 0
+			}
+		}
+	}
+	if hideStart != 0 {
+		annotationErrors = append(annotationErrors, AnnotationError{Line: hideStart, Message: "hide is never ended"})
+	}
+	return nil, annotations, annotationErrors
+}
+
+// a line comment annotation continues over at most this many lines
+const maxContinuationLines = 50
+
+type annotationScanner struct {
+	language Language
+	basename string
+	lines    []string
+}
+
+func (s annotationScanner) trim(line string) string {
+	if s.basename == ".cui.log" {
+		return strings.TrimLeft(line, " 	$")
+	}
+	return strings.TrimLeft(line, " 	")
+}
+
+// scan looks for an annotation starting on line i and returns its body and
+// the index of its last line.
+func (s annotationScanner) scan(i int) (error, bool, string, int) {
+	trimSpace := s.trim(s.lines[i])
+
+	lineComment := s.language.LineComment
+	if lineComment != "" && strings.HasPrefix(trimSpace, lineComment+"@") {
+		err, body, last := s.continueLineComment(strings.TrimSpace(trimSpace[len(lineComment)+1:]), i)
+		return err, true, body, last
+	}
+
+	for _, delimiters := range s.language.blockDelimiters() {
+		start, end := delimiters[0], delimiters[1]
+		if !strings.HasPrefix(trimSpace, start) {
+			continue
+		}
+		rest := trimSpace[len(start):]
+		afterSpace := strings.TrimLeft(rest, " \t")
+		if !strings.HasPrefix(afterSpace, "@") {
+			continue
+		}
+		rest = afterSpace[1:]
+		// "/* @flow */" and the like are not annotations
+		if afterSpace != trimSpace[len(start):] && strings.TrimSpace(rest) != "" && !strings.HasPrefix(strings.TrimSpace(rest), `"`) {
+			continue
+		}
+
+		var body []string
+		for last := i; last < len(s.lines); last++ {
+			if last > i {
+				rest = strings.TrimLeft(s.lines[last], " \t")
+				// decoration of C style blocks
+				if start == "/*" && strings.HasPrefix(rest, "*") && !strings.HasPrefix(rest, end) {
+					rest = rest[1:]
+				}
+			}
+			if n := strings.Index(rest, end); n >= 0 {
+				body = append(body, rest[:n])
+				return nil, true, strings.Join(body, "\n"), last
+			}
+			body = append(body, rest)
+		}
+		return fmt.Errorf("%s is never closed with %s", start, end), true, "", len(s.lines) - 1
+	}
+	return nil, false, "", i
+}
+
+func (s annotationScanner) continueLineComment(body string, i int) (error, string, int) {
+	lineComment := s.language.LineComment
+	last := i
+	for strings.HasSuffix(body, ",") || strings.HasSuffix(body, "\\") {
+		if last+1 >= len(s.lines) || last-i >= maxContinuationLines {
+			return errors.New("annotation continues past the comment"), "", last
+		}
+		next := s.trim(s.lines[last+1])
+		if !strings.HasPrefix(next, lineComment) || strings.HasPrefix(next, lineComment+"@") {
+			return errors.New("annotation continues past the comment"), "", last
+		}
+		last++
+		text := strings.TrimSpace(next[len(lineComment):])
+		if strings.HasSuffix(body, "\\") {
+			body = strings.TrimRight(strings.TrimSuffix(body, "\\"), " \t") + " " + text
+		} else {
+			body += " " + text
+		}
+	}
+	return nil, body, last
+}
+
+// parseAnnotationLine reads the keys of one annotation comment, sorted so
+// a line with several keys always gives the same list. A key that cannot
+// be used is reported on its own, the other keys of the line are kept.
+func parseAnnotationLine(body string, line int, lineCount int) (error, []Annotation, []AnnotationError) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal([]byte("{"+body+"}"), &fields)
+	if err != nil {
+		return fmt.Errorf("annotation is not valid: %v", err), nil, nil
+	}
+	if len(fields) == 0 {
+		return errors.New("annotation is empty"), nil, nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var annotations []Annotation
+	var keyErrors []AnnotationError
+	for _, key := range keys {
+		err, annotation := parseAnnotation(key, fields[key], line, lineCount)
+		if err != nil {
+			keyErrors = append(keyErrors, AnnotationError{Line: line, Message: err.Error()})
+			continue
+		}
+		annotations = append(annotations, annotation)
+	}
+	return nil, annotations, keyErrors
+}
+
+func parseAnnotation(key string, value json.RawMessage, line int, lineCount int) (error, Annotation) {
+	annotation := Annotation{Line: line, Kind: key}
+	switch key {
+	case "content", AnnotationHeading, AnnotationNote, AnnotationChapter:
+		if key == "content" {
+			annotation.Kind = AnnotationHeading
+		}
+		err := json.Unmarshal(value, &annotation.Content)
+		if err != nil || annotation.Content == "" {
+			return fmt.Errorf("%s needs a text", key), annotation
+		}
+	case AnnotationHighlight, AnnotationHide:
+		var marker string
+		if key == AnnotationHide && json.Unmarshal(value, &marker) == nil && (marker == "start" || marker == "end") {
+			annotation.Content = marker
+			return nil, annotation
+		}
+		err, from, to := parseLineRange(value)
+		if err != nil {
+			return fmt.Errorf("%s %v", key, err), annotation
+		}
+		if to > lineCount {
+			return fmt.Errorf("%s ends after the last line %d", key, lineCount), annotation
+		}
+		annotation.From, annotation.To = from, to
+	case AnnotationPause:
+		err, duration := parseDuration(value)
+		if err != nil {
+			return err, annotation
+		}
+		annotation.Duration = duration
+	case AnnotationFocus:
+		err := json.Unmarshal(value, &annotation.File)
+		if err != nil || annotation.File == "" {
+			return errors.New("focus needs a file"), annotation
+		}
+		if path.IsAbs(annotation.File) || strings.HasPrefix(path.Clean(annotation.File), "..") {
+			return errors.New("focus file must be inside the project"), annotation
+		}
+	default:
+		return fmt.Errorf("unknown annotation %q", key), annotation
+	}
+	return nil, annotation
+}
+
+// parseLineRange reads "3-7", "3", 3 or [3, 7].
+func parseLineRange(value json.RawMessage) (error, int, int) {
+	var from, to int
+	var text string
+	var bounds []int
+	if json.Unmarshal(value, &from) == nil {
+		to = from
+	} else if json.Unmarshal(value, &bounds) == nil && len(bounds) == 2 {
+		from, to = bounds[0], bounds[1]
+	} else if json.Unmarshal(value, &text) == nil {
+		parts := strings.SplitN(text, "-", 2)
+		var err error
+		from, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return errors.New("needs a line or a range like \"3-7\""), 0, 0
+		}
+		to = from
+		if len(parts) == 2 {
+			to, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return errors.New("needs a line or a range like \"3-7\""), 0, 0
+			}
+		}
+	} else {
+		return errors.New("needs a line or a range like \"3-7\""), 0, 0
+	}
+	if from < 1 || to < from {
+		return fmt.Errorf("range %d-%d is invalid", from, to), 0, 0
+	}
+	return nil, from, to
+}
+
+// parseDuration reads milliseconds or a duration like "1.5s".
+func parseDuration(value json.RawMessage) (error, int64) {
+	var millis float64
+	var text string
+	if json.Unmarshal(value, &millis) != nil {
+		if json.Unmarshal(value, &text) != nil {
+			return errors.New("pause needs milliseconds or a duration like \"1.5s\""), 0
+		}
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return errors.New("pause needs milliseconds or a duration like \"1.5s\""), 0
+		}
+		millis = float64(d / time.Millisecond)
+	}
+	if millis <= 0 || millis > float64(maxPause/time.Millisecond) {
+		return fmt.Errorf("pause must be between 1ms and %v", maxPause), 0
+	}
+	return nil, int64(millis)
+}
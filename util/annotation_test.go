@@ -0,0 +1,140 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	code := `#@ "content": "Intro"
+import os
+#@ "note": "reads the cwd", "highlight": "4-5"
+print(os.getcwd())
+print(1)
+#@ "pause": "1.5s"
+#@ "chapter": "Cleanup"
+#@ "focus": "src/main.py"
+#@ "hide": "start"
+secret = 1
+#@ "hide": "end"
+#@ "hide": [2, 3]
+#@ "heading": "Outro"`
+	err, annotations, annotationErrors := ParseAnnotations(code, "python", "a.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Annotation{
+		{Line: 1, Kind: AnnotationHeading, Content: "Intro"},
+		{Line: 3, Kind: AnnotationHighlight, From: 4, To: 5},
+		{Line: 3, Kind: AnnotationNote, Content: "reads the cwd"},
+		{Line: 6, Kind: AnnotationPause, Duration: 1500},
+		{Line: 7, Kind: AnnotationChapter, Content: "Cleanup"},
+		{Line: 8, Kind: AnnotationFocus, File: "src/main.py"},
+		{Line: 9, Kind: AnnotationHide, From: 9, To: 11},
+		{Line: 12, Kind: AnnotationHide, From: 2, To: 3},
+		{Line: 13, Kind: AnnotationHeading, Content: "Outro"},
+	}
+	if !reflect.DeepEqual(annotations, want) {
+		t.Fatalf("failed annotations\ngot  %+v\nwant %+v", annotations, want)
+	}
+	if len(annotationErrors) != 0 {
+		t.Fatalf("failed errors %+v", annotationErrors)
+	}
+
+	err, commands := GetCommands(code, "python", "a.py")
+	if err != nil || commands.Content != "Outro" {
+		t.Fatalf("failed commands %+v %v", commands, err)
+	}
+}
+
+func TestParseAnnotationsErrors(t *testing.T) {
+	code := `//@ "content": "ok"
+//@ not json
+//@ "highlight": "9-12"
+//@ "pause": -1
+//@ "focus": "../etc/passwd"
+//@ "shout": "hi"
+//@ "hide": "end"
+//@ "hide": "start"`
+	err, annotations, annotationErrors := ParseAnnotations(code, "javascript", "a.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 1 {
+		t.Fatalf("failed annotations %+v", annotations)
+	}
+	var lines []int
+	for _, annotationError := range annotationErrors {
+		lines = append(lines, annotationError.Line)
+	}
+	if want := []int{2, 3, 4, 5, 6, 7, 8}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("failed error lines %v, want %v: %+v", lines, want, annotationErrors)
+	}
+}
+
+func TestParseAnnotationsUnknownKey(t *testing.T) {
+	err, annotations, annotationErrors := ParseAnnotations(`#@ "content": "x", "other": 1`, "python", "a.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Annotation{{Line: 1, Kind: AnnotationHeading, Content: "x"}}; !reflect.DeepEqual(annotations, want) {
+		t.Fatalf("failed annotations\ngot  %+v\nwant %+v", annotations, want)
+	}
+	if want := []AnnotationError{{Line: 1, Message: `unknown annotation "other"`}}; !reflect.DeepEqual(annotationErrors, want) {
+		t.Fatalf("failed errors\ngot  %+v\nwant %+v", annotationErrors, want)
+	}
+
+	err, commands := GetCommands(`#@ "content": "x", "other": 1`, "python", "a.py")
+	if err != nil || commands.Content != "x" {
+		t.Fatalf("failed commands %+v: %v", commands, err)
+	}
+}
+
+func TestParseAnnotationsHTML(t *testing.T) {
+	err, annotations, _ := ParseAnnotations(`<p>hi</p>
+<!--@ "heading": "Markup" -->`, "html", "a.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 1 || annotations[0].Content != "Markup" {
+		t.Fatalf("failed annotations %+v", annotations)
+	}
+}
+
+func TestParseAnnotationsBlocks(t *testing.T) {
+	cases := []struct {
+		lang string
+		code string
+		want []Annotation
+	}{
+		{"javascript", `/* @ "heading": "One line" */`, []Annotation{{Line: 1, Kind: AnnotationHeading, Content: "One line"}}},
+		{"javascript", "let a\n/*@\n * \"heading\": \"Several\",\n * \"pause\": 300\n */\nlet b", []Annotation{
+			{Line: 2, Kind: AnnotationHeading, Content: "Several"},
+			{Line: 2, Kind: AnnotationPause, Duration: 300},
+		}},
+		{"html", "<!--@\n  \"chapter\": \"Markup\"\n-->\n<p>hi</p>", []Annotation{{Line: 1, Kind: AnnotationChapter, Content: "Markup"}}},
+		{"python", `"""@ "note": "docstring" """`, []Annotation{{Line: 1, Kind: AnnotationNote, Content: "docstring"}}},
+		{"python", "def f():\n    '''@\n    \"heading\": \"Inside\"\n    '''\n    pass", []Annotation{{Line: 2, Kind: AnnotationHeading, Content: "Inside"}}},
+		{"bash", "#@ \"heading\": \"Long\",\n#   \"note\": \"a long \\\n#   note\"\necho", []Annotation{
+			{Line: 1, Kind: AnnotationHeading, Content: "Long"},
+			{Line: 1, Kind: AnnotationNote, Content: "a long note"},
+		}},
+		{"c", "/*@ \"hide\": \"start\" */\nint secret;\n/*@\n\"hide\": \"end\"\n*/", []Annotation{{Line: 1, Kind: AnnotationHide, From: 1, To: 5}}},
+		// pragmas and doc comments are no annotations
+		{"javascript", "/* @flow */\n/** @param x */\n// @ts-ignore", []Annotation{}},
+	}
+	for _, c := range cases {
+		err, annotations, annotationErrors := ParseAnnotations(c.code, c.lang, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(annotations, c.want) || len(annotationErrors) != 0 {
+			t.Errorf("failed %q\ngot  %+v %+v\nwant %+v", c.code, annotations, annotationErrors, c.want)
+		}
+	}
+
+	_, _, annotationErrors := ParseAnnotations("/*@ \"heading\": \"open\"\nlet a", "javascript", "a.js")
+	if len(annotationErrors) != 1 || annotationErrors[0].Line != 1 {
+		t.Fatalf("failed unclosed %+v", annotationErrors)
+	}
+}
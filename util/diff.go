@@ -0,0 +1,98 @@
+package util
+
+import (
+	"strings"
+)
+
+// Hunk replaces Delete lines of the old text, starting at line Start
+// (0-based, counted in the old text), with the Insert lines.
+type Hunk struct {
+	Start  int      `json:"start" bson:"start"`
+	Delete int      `json:"delete" bson:"delete"`
+	Insert []string `json:"insert" bson:"insert"`
+}
+
+// beyond this the middle part is sent as one replacement hunk
+const maxDiffCells = 4000000
+
+func DiffLines(oldText string, newText string) []Hunk {
+	if oldText == newText {
+		return nil
+	}
+	a := strings.Split(oldText, "\n")
+	b := strings.Split(newText, "\n")
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a = a[prefix : len(a)-suffix]
+	b = b[prefix : len(b)-suffix]
+
+	if len(a) == 0 || len(b) == 0 || len(a)*len(b) > maxDiffCells {
+		return []Hunk{Hunk{Start: prefix, Delete: len(a), Insert: b}}
+	}
+
+	// lcs[i*(m+1)+j] is the LCS length of a[i:] and b[j:]
+	n, m := len(a), len(b)
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			} else if lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+			} else {
+				lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+			}
+		}
+	}
+
+	var hunks []Hunk
+	var hunk *Hunk
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && a[i] == b[j] {
+			if hunk != nil {
+				hunks = append(hunks, *hunk)
+				hunk = nil
+			}
+			i++
+			j++
+			continue
+		}
+		if hunk == nil {
+			hunk = &Hunk{Start: prefix + i, Insert: []string{}}
+		}
+		if j >= m || (i < n && lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]) {
+			hunk.Delete++
+			i++
+		} else {
+			hunk.Insert = append(hunk.Insert, b[j])
+			j++
+		}
+	}
+	if hunk != nil {
+		hunks = append(hunks, *hunk)
+	}
+	return hunks
+}
+
+// ApplyHunks rebuilds the new text from the old text and the hunks
+// returned by DiffLines.
+func ApplyHunks(oldText string, hunks []Hunk) string {
+	a := strings.Split(oldText, "\n")
+	var b []string
+	pos := 0
+	for _, hunk := range hunks {
+		b = append(b, a[pos:hunk.Start]...)
+		b = append(b, hunk.Insert...)
+		pos = hunk.Start + hunk.Delete
+	}
+	b = append(b, a[pos:]...)
+	return strings.Join(b, "\n")
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestDiffLinesRoundTrip(t *testing.T) {
+	cases := [][2]string{
+		{"", "print(1)"},
+		{"a\nb\nc", "a\nc"},
+		{"a\nb\nc", "a\nB\nc\nd"},
+		{"x\ny\n", "y\nx\n"},
+		{"same", "same"},
+	}
+	for _, c := range cases {
+		hunks := DiffLines(c[0], c[1])
+		if got := ApplyHunks(c[0], hunks); got != c[1] {
+			t.Fatalf("failed %q -> %q: got %q", c[0], c[1], got)
+		}
+	}
+
+	hunks := DiffLines("a\nb\nc", "a\nB\nc")
+	if len(hunks) != 1 || hunks[0].Start != 1 || hunks[0].Delete != 1 || hunks[0].Insert[0] != "B" {
+		t.Fatalf("failed hunk %+v", hunks)
+	}
+}
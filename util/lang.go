@@ -0,0 +1,378 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const Plaintext = "plaintext"
+
+// Language tells how files of a language are recognized and how its
+// comments look. BlockComment holds the start and end marks. Patterns are
+// regular expressions of code typical for the language, used when the
+// name of a file is not enough.
+type Language struct {
+	ID           string   `json:"id"`
+	Extensions   []string `json:"extensions"`
+	Filenames    []string `json:"filenames"`
+	Interpreters []string `json:"interpreters"`
+	Aliases      []string `json:"aliases"`
+	LineComment  string   `json:"lineComment"`
+	BlockComment []string `json:"blockComment"`
+	// Docstrings are marks that start and end a string used as a comment
+	Docstrings []string `json:"docstrings"`
+	Patterns   []string `json:"patterns"`
+}
+
+// blockDelimiters lists the start and end marks of the block comments and
+// docstrings.
+func (l Language) blockDelimiters() [][2]string {
+	var delimiters [][2]string
+	if len(l.BlockComment) == 2 {
+		delimiters = append(delimiters, [2]string{l.BlockComment[0], l.BlockComment[1]})
+	}
+	for _, docstring := range l.Docstrings {
+		delimiters = append(delimiters, [2]string{docstring, docstring})
+	}
+	return delimiters
+}
+
+// Detection is a detected language with how sure the detection is, from
+// 0 for the plaintext fallback to 1 for an exact file name or a modeline.
+type Detection struct {
+	Lang       string  `json:"lang"`
+	Confidence float64 `json:"confidence"`
+}
+
+const (
+	confidenceExact     = 1
+	confidenceExtension = 0.9
+	confidenceShebang   = 0.9
+	// an ambiguous extension nothing in the code decides on
+	confidenceAmbiguous = 0.5
+)
+
+// CommentMark is the mark that starts a comment, the line comment when
+// the language has one.
+func (l Language) CommentMark() string {
+	if l.LineComment != "" {
+		return l.LineComment
+	}
+	if len(l.BlockComment) == 2 {
+		return l.BlockComment[0]
+	}
+	return ""
+}
+
+var builtinLanguages = []Language{
+	{ID: Plaintext, Extensions: []string{".txt"}, LineComment: "//"},
+	{
+		ID: "python", Extensions: []string{".py", ".pyw"}, Interpreters: []string{"python", "python2", "python3"}, Aliases: []string{"py"}, LineComment: "#", Docstrings: []string{`"""`, "'''"},
+		Patterns: []string{`^\s*def \w+\(.*\)\s*(->.*)?:\s*$`, `^\s*from [\w.]+ import `, `^\s*import \w+(\.\w+)*\s*$`, `^\s*class \w+(\(.*\))?:\s*$`, `^if __name__ == ['"]__main__['"]:`, `\bself\.\w+`},
+	},
+	// .cui.log is the terminal transcript of a recording
+	{
+		ID: "bash", Extensions: []string{".sh", ".bash"}, Filenames: []string{".cui.log", ".bashrc", ".bash_profile"}, Interpreters: []string{"sh", "bash"}, Aliases: []string{"sh", "shell"}, LineComment: "#",
+		Patterns: []string{`^\s*(fi|esac|done)\s*$`, `^\s*if \[\[? `, `^\s*export \w+=`, `^\s*echo [\w"'$]`, `\$\{\w+[:#%}]`},
+	},
+	{
+		ID: "javascript", Extensions: []string{".js", ".mjs", ".cjs"}, Interpreters: []string{"node", "nodejs"}, Aliases: []string{"js"}, LineComment: "//", BlockComment: []string{"/*", "*/"},
+		Patterns: []string{`^\s*(const|let|var) \w+ = `, `\bfunction\s*\w*\s*\(`, `\bconsole\.log\(`, `\brequire\(['"]`, `\) => \{`, `^\s*module\.exports\b`},
+	},
+	{
+		ID: "typescript", Extensions: []string{".ts"}, Interpreters: []string{"ts-node", "deno"}, Aliases: []string{"ts"}, LineComment: "//", BlockComment: []string{"/*", "*/"},
+		Patterns: []string{`^\s*(export )?interface \w+`, `^\s*(export )?type \w+ = `, `\w+: (string|number|boolean)\b`, `^import .* from ['"]`},
+	},
+	{
+		ID: "html", Extensions: []string{".html", ".htm"}, BlockComment: []string{"<!--", "-->"},
+		Patterns: []string{`(?i)<!DOCTYPE html`, `(?i)<html[\s>]`, `(?i)<(head|body)>`, `(?i)</(div|p|span|a)>`},
+	},
+	{ID: "css", Extensions: []string{".css"}, BlockComment: []string{"/*", "*/"}},
+	{
+		ID: "go", Extensions: []string{".go"}, Aliases: []string{"golang"}, LineComment: "//", BlockComment: []string{"/*", "*/"},
+		Patterns: []string{`^package \w+\s*$`, `^func (\(\w+ \*?\w+\) )?\w+\(`, `^import \($`, `\w+ := `, `\bfmt\.Print`},
+	},
+	{
+		ID: "c", Extensions: []string{".c", ".h"}, LineComment: "//", BlockComment: []string{"/*", "*/"},
+		Patterns: []string{`^#include\s*[<"]`, `^#define \w+`, `\bprintf\(`, `\b(malloc|free)\(`, `^(static )?(int|void|char) \*?\w+\(`},
+	},
+	{
+		ID: "cpp", Extensions: []string{".cpp", ".cc", ".cxx", ".hpp", ".h"}, Aliases: []string{"c++"}, LineComment: "//", BlockComment: []string{"/*", "*/"},
+		Patterns: []string{`\bstd::`, `^#include <(iostream|vector|string|map|memory)>`, `^\s*template\s*<`, `^\s*namespace \w+`, `^\s*class \w+(\s*:\s*(public|private|protected) \w+)?\s*\{?\s*$`, `\b(public|private|protected):`},
+	},
+	{
+		ID: "objective-c", Extensions: []string{".m", ".mm", ".h"}, Aliases: []string{"objc"}, LineComment: "//", BlockComment: []string{"/*", "*/"},
+		Patterns: []string{`^\s*@(interface|implementation|protocol)\b`, `^\s*@end\b`, `^#import\s*[<"]`, `\bNS(String|Object|Log)\b`, `^[-+]\s*\(\w+\s*\*?\)`},
+	},
+	{
+		ID: "matlab", Extensions: []string{".m"}, LineComment: "%",
+		Patterns: []string{`^\s*function\s+(\[?[\w, ]*\]?\s*=\s*)?\w+\(`, `^\s*%`, `^\s*end\s*$`, `\b(zeros|ones|disp|fprintf)\(`, `^\s*(elseif|endfunction)\b`},
+	},
+	{
+		ID: "java", Extensions: []string{".java"}, LineComment: "//", BlockComment: []string{"/*", "*/"},
+		Patterns: []string{`^\s*public (final )?(class|interface) \w+`, `\bpublic static void main\(`, `\bSystem\.out\.print`, `^import java\.`},
+	},
+	{
+		ID: "ruby", Extensions: []string{".rb"}, Filenames: []string{"Gemfile", "Rakefile"}, Interpreters: []string{"ruby"}, Aliases: []string{"rb"}, LineComment: "#",
+		Patterns: []string{`^\s*require ['"]`, `^\s*def \w+[?!]?(\(.*\))?\s*$`, `\bputs\b`, `\.each do\b`, `^\s*end\s*$`},
+	},
+	{ID: "makefile", Extensions: []string{".mk"}, Filenames: []string{"Makefile", "makefile", "GNUmakefile"}, Aliases: []string{"make"}, LineComment: "#"},
+	{ID: "dockerfile", Filenames: []string{"Dockerfile"}, Aliases: []string{"docker"}, LineComment: "#"},
+	{ID: "yaml", Extensions: []string{".yaml", ".yml"}, Aliases: []string{"yml"}, LineComment: "#"},
+}
+
+// Registry maps file names and contents to languages.
+type Registry struct {
+	mu        sync.RWMutex
+	languages map[string]Language
+	// ids in the order of registration, earlier ones win ties
+	order []string
+	// an extension can be claimed by several languages, like .h
+	byExtension   map[string][]string
+	byFilename    map[string]string
+	byInterpreter map[string]string
+	byAlias       map[string]string
+	patterns      map[string][]*regexp.Regexp
+	// fingerprint changes with any language, see Fingerprint
+	fingerprint string
+}
+
+func NewRegistry(languages []Language) *Registry {
+	r := &Registry{languages: map[string]Language{}}
+	r.Register(languages...)
+	return r
+}
+
+// Languages is the registry used by GetCommands and the server.
+var Languages = NewRegistry(builtinLanguages)
+
+// Register adds the languages, replacing the ones with the same id.
+func (r *Registry) Register(languages ...Language) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, language := range languages {
+		if _, ok := r.languages[language.ID]; !ok {
+			r.order = append(r.order, language.ID)
+		}
+		r.languages[language.ID] = language
+	}
+
+	// rebuilt so names of a replaced language do not linger
+	r.byExtension = map[string][]string{}
+	r.byFilename = map[string]string{}
+	r.byInterpreter = map[string]string{}
+	r.byAlias = map[string]string{}
+	r.patterns = map[string][]*regexp.Regexp{}
+	for _, id := range r.order {
+		language := r.languages[id]
+		for _, extension := range language.Extensions {
+			extension = strings.ToLower(extension)
+			r.byExtension[extension] = append(r.byExtension[extension], id)
+		}
+		for _, filename := range language.Filenames {
+			r.byFilename[filename] = id
+		}
+		for _, interpreter := range language.Interpreters {
+			r.byInterpreter[interpreter] = id
+		}
+		r.byAlias[strings.ToLower(id)] = id
+		for _, alias := range language.Aliases {
+			r.byAlias[strings.ToLower(alias)] = id
+		}
+		for _, pattern := range language.Patterns {
+			// Load reports invalid patterns, others are skipped
+			if re, err := regexp.Compile("(?m)" + pattern); err == nil {
+				r.patterns[id] = append(r.patterns[id], re)
+			}
+		}
+	}
+
+	hash := sha256.New()
+	for _, id := range r.order {
+		languageJSON, _ := json.Marshal(r.languages[id])
+		hash.Write(languageJSON)
+	}
+	r.fingerprint = hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// Fingerprint identifies the registered languages, so results computed with
+// them can be told apart from ones computed before a language changed.
+func (r *Registry) Fingerprint() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.fingerprint
+}
+
+// Load registers the languages listed in a JSON file.
+func (r *Registry) Load(languagesPath string) error {
+	languagesJSON, err := ioutil.ReadFile(languagesPath)
+	if err != nil {
+		return err
+	}
+	var languages []Language
+	err = json.Unmarshal(languagesJSON, &languages)
+	if err != nil {
+		return err
+	}
+	for _, language := range languages {
+		if language.ID == "" {
+			return errors.New("language file entries need an id")
+		}
+		if len(language.BlockComment) != 0 && len(language.BlockComment) != 2 {
+			return errors.New("blockComment of " + language.ID + " needs a start and an end mark")
+		}
+		for _, pattern := range language.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return errors.New("pattern of " + language.ID + ": " + err.Error())
+			}
+		}
+	}
+	r.Register(languages...)
+	return nil
+}
+
+func (r *Registry) Lookup(id string) (Language, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	language, ok := r.languages[id]
+	return language, ok
+}
+
+// Detect names the language of a file: by its exact name, a modeline, its
+// extension, then its shebang line. Ambiguous extensions and unknown files
+// are decided by the code. Anything else is plaintext.
+func (r *Registry) Detect(name string, code string) Detection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	baseName := path.Base(name)
+	if id, ok := r.byFilename[baseName]; ok {
+		return Detection{Lang: id, Confidence: confidenceExact}
+	}
+	if id, ok := r.byAlias[strings.ToLower(modeline(code))]; ok {
+		return Detection{Lang: id, Confidence: confidenceExact}
+	}
+	candidates := r.byExtension[strings.ToLower(path.Ext(baseName))]
+	if len(candidates) == 1 {
+		return Detection{Lang: candidates[0], Confidence: confidenceExtension}
+	}
+	if len(candidates) > 1 {
+		if detection, ok := r.sniff(code, candidates, 1); ok {
+			return detection
+		}
+		return Detection{Lang: candidates[0], Confidence: confidenceAmbiguous}
+	}
+	if id, ok := r.byInterpreter[shebang(code)]; ok {
+		return Detection{Lang: id, Confidence: confidenceShebang}
+	}
+	// python3.8 -> python3 -> python
+	interpreter := strings.TrimRight(shebang(code), "0123456789.")
+	if id, ok := r.byInterpreter[interpreter]; ok {
+		return Detection{Lang: id, Confidence: confidenceShebang}
+	}
+	// without any hint from the name one pattern is too easily hit
+	if detection, ok := r.sniff(code, r.order, 2); ok {
+		return detection
+	}
+	return Detection{Lang: Plaintext}
+}
+
+// only the start of large files is looked at
+const sniffBytes = 64000
+
+// sniff scores the candidates by how many of their patterns the code
+// matches and returns the best one when it matches at least minMatches.
+// Ties go to the earlier candidate.
+func (r *Registry) sniff(code string, candidates []string, minMatches int) (Detection, bool) {
+	if len(code) > sniffBytes {
+		code = code[:sniffBytes]
+	}
+
+	best, bestMatches, total := "", 0, 0
+	for _, id := range candidates {
+		matches := 0
+		for _, re := range r.patterns[id] {
+			if re.MatchString(code) {
+				matches++
+			}
+		}
+		total += matches
+		if matches > bestMatches {
+			best, bestMatches = id, matches
+		}
+	}
+	if bestMatches < minMatches {
+		return Detection{}, false
+	}
+
+	// more evidence and less of it for the other candidates make it surer
+	confidence := 0.3 + 0.1*float64(bestMatches)
+	if confidence > 0.8 {
+		confidence = 0.8
+	}
+	confidence *= float64(bestMatches) / float64(total)
+	return Detection{Lang: best, Confidence: math.Round(confidence*100) / 100}, true
+}
+
+// shebang returns the interpreter named by the first line, following env.
+func shebang(code string) string {
+	if !strings.HasPrefix(code, "#!") {
+		return ""
+	}
+	firstLine := code[2:]
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+	fields := strings.Fields(firstLine)
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter != "env" {
+		return interpreter
+	}
+	// #!/usr/bin/env -S python3 -u
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+			return path.Base(field)
+		}
+	}
+	return ""
+}
+
+var (
+	vimModeline   = regexp.MustCompile(`(?:^|\s)(?:vi|vim|ex):.*?(?:ft|filetype|syntax)=([\w+-]+)`)
+	emacsModeline = regexp.MustCompile(`-\*-\s*(?:.*?mode:\s*)?([\w+-]+)\s*;?.*?-\*-`)
+)
+
+// modelines are only looked for this many lines from the start or the end
+const modelineLines = 5
+
+// modeline returns the language named by a vim or emacs modeline.
+func modeline(code string) string {
+	lines := strings.Split(code, "\n")
+	candidates := lines
+	if len(lines) > 2*modelineLines {
+		candidates = append(append([]string{}, lines[:modelineLines]...), lines[len(lines)-modelineLines:]...)
+	}
+	for _, line := range candidates {
+		if match := vimModeline.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+		if match := emacsModeline.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		name string
+		code string
+		lang string
+	}{
+		{"a.py", "", "python"},
+		{"src/A.PY", "", "python"},
+		{"main.go", "", "go"},
+		{"Makefile", "all:\n", "makefile"},
+		{"app/Dockerfile", "FROM scratch\n", "dockerfile"},
+		{".cui.log", "$ ls\n", "bash"},
+		{"run", "#!/bin/bash\necho\n", "bash"},
+		{"run", "#!/usr/bin/env -S python3.8 -u\n", "python"},
+		{"run", "#!/usr/bin/env node\n", "javascript"},
+		{"notes.txt", "x\n# vim: set ft=ruby :\n", "ruby"},
+		{"a.conf", "# -*- mode: yaml -*-\n", "yaml"},
+		{"a.conf", "# -*- coding: utf-8; mode: python -*-\n", "python"},
+		{"a.txt", "# -*- coding: utf-8 -*-\n", "plaintext"},
+		{"unknown", "", "plaintext"},
+		{"a.h", "#include <stdio.h>\nint add(int a, int b);\n", "c"},
+		{"a.h", "#include <vector>\nnamespace geo {\nclass Point {\npublic:\n};\n}\n", "cpp"},
+		{"a.h", "#import <Foundation/Foundation.h>\n@interface Point : NSObject\n@end\n", "objective-c"},
+		{"a.m", "function y = square(x)\n  % squares x\n  y = x .^ 2;\nend\n", "matlab"},
+		{"a.m", "#import \"Point.h\"\n@implementation Point\n@end\n", "objective-c"},
+		{"script", "import os\n\ndef main():\n    print(os.getcwd())\n", "python"},
+		{"script", "package main\n\nfunc main() {\n\tx := 1\n}\n", "go"},
+		{"README", "Install it with make.\n", "plaintext"},
+	}
+	for _, c := range cases {
+		if detection := Languages.Detect(c.name, c.code); detection.Lang != c.lang {
+			t.Errorf("failed %s: got %s, want %s", c.name, detection.Lang, c.lang)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	registry := NewRegistry(builtinLanguages)
+	registry.Register(Language{ID: "lua", Extensions: []string{".lua"}, Interpreters: []string{"lua"}, LineComment: "--"})
+	registry.Register(Language{ID: "python", Extensions: []string{".py3"}, LineComment: "#"})
+
+	if detection := registry.Detect("a.lua", ""); detection.Lang != "lua" {
+		t.Fatalf("failed lua: got %s", detection.Lang)
+	}
+	if detection := registry.Detect("a.py3", ""); detection.Lang != "python" {
+		t.Fatalf("failed py3: got %s", detection.Lang)
+	}
+	// the replaced python no longer claims .py
+	if detection := registry.Detect("a.py", ""); detection.Lang != Plaintext {
+		t.Fatalf("failed py: got %s", detection.Lang)
+	}
+	if language, _ := registry.Lookup("lua"); language.CommentMark() != "--" {
+		t.Fatalf("failed lua comment: got %q", language.CommentMark())
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	registry := NewRegistry(builtinLanguages)
+	fingerprint := registry.Fingerprint()
+	if fingerprint == "" || fingerprint != NewRegistry(builtinLanguages).Fingerprint() {
+		t.Fatalf("same languages give fingerprints %q and %q", fingerprint, NewRegistry(builtinLanguages).Fingerprint())
+	}
+
+	registry.Register(Language{ID: "python", Extensions: []string{".py"}, LineComment: "#"})
+	if registry.Fingerprint() == fingerprint {
+		t.Fatal("fingerprint did not change with python")
+	}
+}
+
+func TestDetectConfidence(t *testing.T) {
+	exact := Languages.Detect("Makefile", "")
+	extension := Languages.Detect("a.py", "")
+	sniffed := Languages.Detect("script", "import os\n\ndef main():\n    pass\n")
+	fallback := Languages.Detect("README", "")
+	if !(exact.Confidence > extension.Confidence && extension.Confidence > sniffed.Confidence && sniffed.Confidence > fallback.Confidence) {
+		t.Fatalf("failed order: %v %v %v %v", exact, extension, sniffed, fallback)
+	}
+	if fallback.Confidence != 0 {
+		t.Fatalf("failed fallback: %v", fallback)
+	}
+}
@@ -0,0 +1,158 @@
+package util
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kinds of terminal events. A prompt is a prompt nothing was typed at yet.
+const (
+	TerminalPrompt  = "prompt"
+	TerminalCommand = "command"
+	TerminalOutput  = "output"
+	TerminalExit    = "exit"
+)
+
+// TerminalEvent is one step of a terminal transcript. Line is the 1-based
+// line of the log it starts at; Output holds the lines of an output chunk
+// with escape sequences removed.
+type TerminalEvent struct {
+	Kind    string `json:"kind" bson:"kind"`
+	Line    int    `json:"line" bson:"line"`
+	Prompt  string `json:"prompt,omitempty" bson:"prompt,omitempty"`
+	Command string `json:"command,omitempty" bson:"command,omitempty"`
+	Output  string `json:"output,omitempty" bson:"output,omitempty"`
+	Status  *int   `json:"status,omitempty" bson:"status,omitempty"`
+}
+
+var (
+	// "$ ", "(venv) user@host:~/src$ ", "[user@host src]# ", "❯ "; a bare
+	// "#", "%" or ">" is too common in output to count without user@host
+	promptPattern = regexp.MustCompile(`^((?:\([\w.-]+\) )?(?:(?:[\w.-]+@[\w.-]+(?::[^\s$#%>]*)?|\[[\w.-]+@[\w.-]+[^\]]*\])[$#%>]|[$❯]))(?: (.*))?$`)
+	exitPatterns  = []*regexp.Regexp{
+		regexp.MustCompile(`^\[(?:exit|status|exit status)[: ]\s*(\d+)\]$`),
+		regexp.MustCompile(`^exit status (\d+)$`),
+		regexp.MustCompile(`^Process finished with exit code (\d+)$`),
+		regexp.MustCompile(`^(?:command )?exited with (?:code|status) (\d+)$`),
+	}
+	ansiPattern = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|\x1b[@-Z\\\\-_]")
+)
+
+// StripANSI removes escape sequences and applies carriage returns and
+// backspaces the way a terminal shows the line.
+func StripANSI(line string) string {
+	line = ansiPattern.ReplaceAllString(strings.TrimSuffix(line, "\r"), "")
+	// a progress bar redraws the line after \r
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	if !strings.Contains(line, "\b") {
+		return line
+	}
+	var runes []rune
+	for _, r := range line {
+		if r == '\b' {
+			if len(runes) > 0 {
+				runes = runes[:len(runes)-1]
+			}
+			continue
+		}
+		runes = append(runes, r)
+	}
+	return string(runes)
+}
+
+// ParseTerminal splits a terminal transcript like .cui.log into prompts,
+// commands, output chunks and the exit statuses the shell printed.
+// Annotations typed at the prompt are left to ParseAnnotations.
+func ParseTerminal(log string) []TerminalEvent {
+	lines := strings.Split(log, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	events := []TerminalEvent{}
+	var output []string
+	outputLine := 0
+	flush := func() {
+		if len(output) > 0 {
+			events = append(events, TerminalEvent{Kind: TerminalOutput, Line: outputLine, Output: strings.Join(output, "\n")})
+			output = nil
+		}
+	}
+
+	skipping := false
+	for i, raw := range lines {
+		line := StripANSI(raw)
+		lineNumber := i + 1
+
+		if match := promptPattern.FindStringSubmatch(line); match != nil {
+			flush()
+			command := strings.TrimSpace(match[2])
+			skipping = strings.HasPrefix(command, "#@")
+			if skipping {
+				continue
+			}
+			event := TerminalEvent{Kind: TerminalCommand, Line: lineNumber, Prompt: match[1], Command: command}
+			if command == "" {
+				event.Kind = TerminalPrompt
+			}
+			events = append(events, event)
+			continue
+		}
+		// continued lines of a multi-line annotation
+		if skipping && strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		skipping = false
+
+		if status, ok := exitStatus(line); ok {
+			flush()
+			events = append(events, TerminalEvent{Kind: TerminalExit, Line: lineNumber, Status: &status})
+			continue
+		}
+
+		if len(output) == 0 {
+			outputLine = lineNumber
+		}
+		output = append(output, line)
+	}
+	flush()
+	return events
+}
+
+func exitStatus(line string) (int, bool) {
+	line = strings.TrimSpace(line)
+	for _, re := range exitPatterns {
+		if match := re.FindStringSubmatch(line); match != nil {
+			status, err := strconv.Atoi(match[1])
+			return status, err == nil
+		}
+	}
+	return 0, false
+}
+
+// NewTerminalEvents compares the events of two frames of a growing
+// transcript. It returns the index from which next differs from prev and
+// the events of next from there: a player drops its events from that
+// index on and appends these.
+func NewTerminalEvents(prev []TerminalEvent, next []TerminalEvent) (int, []TerminalEvent) {
+	from := 0
+	for from < len(prev) && from < len(next) && sameTerminalEvent(prev[from], next[from]) {
+		from++
+	}
+	return from, next[from:]
+}
+
+func sameTerminalEvent(a TerminalEvent, b TerminalEvent) bool {
+	if a.Status != nil && b.Status != nil {
+		if *a.Status != *b.Status {
+			return false
+		}
+	} else if a.Status != b.Status {
+		return false
+	}
+	a.Status, b.Status = nil, nil
+	return a == b
+}
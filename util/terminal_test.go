@@ -0,0 +1,67 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"plain", "plain"},
+		{"\x1b[1;32mok\x1b[0m done\r", "ok done"},
+		{"\x1b]0;user@host: ~\x07$ ls", "$ ls"},
+		{" 10%\r 50%\r100%", "100%"},
+		{"lss\b -l", "ls -l"},
+	}
+	for _, test := range tests {
+		if got := StripANSI(test.line); got != test.want {
+			t.Errorf("StripANSI(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseTerminal(t *testing.T) {
+	log := "Last login: Mon\n" +
+		"\x1b[32muser@host\x1b[0m:~/src$ python3 main.py\n" +
+		"hello\n" +
+		"world\n" +
+		"$ #@ \"heading\": \"Build\"\n" +
+		"$ go build\n" +
+		"./main.go:3: undefined: x\n" +
+		"exit status 2\n" +
+		"(venv) [user@host src]# \n"
+	two := 2
+	want := []TerminalEvent{
+		{Kind: TerminalOutput, Line: 1, Output: "Last login: Mon"},
+		{Kind: TerminalCommand, Line: 2, Prompt: "user@host:~/src$", Command: "python3 main.py"},
+		{Kind: TerminalOutput, Line: 3, Output: "hello\nworld"},
+		{Kind: TerminalCommand, Line: 6, Prompt: "$", Command: "go build"},
+		{Kind: TerminalOutput, Line: 7, Output: "./main.go:3: undefined: x"},
+		{Kind: TerminalExit, Line: 8, Status: &two},
+		{Kind: TerminalPrompt, Line: 9, Prompt: "(venv) [user@host src]#"},
+	}
+	if got := ParseTerminal(log); !reflect.DeepEqual(got, want) {
+		t.Fatalf("failed terminal\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestNewTerminalEvents(t *testing.T) {
+	prev := ParseTerminal("$ ls\na.go\n$ \n")
+	next := ParseTerminal("$ ls\na.go\n$ go test\nok\n")
+	from, events := NewTerminalEvents(prev, next)
+	want := []TerminalEvent{
+		{Kind: TerminalCommand, Line: 3, Prompt: "$", Command: "go test"},
+		{Kind: TerminalOutput, Line: 4, Output: "ok"},
+	}
+	if from != 2 || !reflect.DeepEqual(events, want) {
+		t.Fatalf("failed new events from %d\ngot  %+v\nwant %+v", from, events, want)
+	}
+
+	from, events = NewTerminalEvents(next, next)
+	if from != len(next) || len(events) != 0 {
+		t.Fatalf("unchanged transcript gave events from %d: %+v", from, events)
+	}
+}